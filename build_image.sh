@@ -4,5 +4,8 @@ TAG=cubesystems/sentry-forwarder:1.0
 
 docker buildx build . \
   -t $TAG \
+  --build-arg VERSION="$(git describe --tags --always --dirty 2>/dev/null || echo dev)" \
+  --build-arg GIT_COMMIT="$(git rev-parse HEAD 2>/dev/null)" \
+  --build-arg BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
   --platform linux/amd64 \
   --push
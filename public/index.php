@@ -1,109 +1,244 @@
 <?php
 
 require_once '../vendor/autoload.php';
+require_once '../src/config.php';
+require_once '../src/client.php';
+require_once '../src/metrics.php';
+require_once '../src/spool.php';
+require_once '../src/forwarding.php';
 
-use GuzzleHttp\Client;
+use GuzzleHttp\Psr7\Utils;
 use Psr\Http\Message\ResponseInterface as Response;
 use Psr\Http\Message\ServerRequestInterface as Request;
+use Psr\Http\Server\RequestHandlerInterface as RequestHandler;
+use SentryForwarder\Forwarder;
+use Slim\Exception\HttpMethodNotAllowedException;
 use Slim\Factory\AppFactory;
-use Symfony\Component\Yaml\Yaml;
+use Slim\Routing\RouteCollectorProxy;
 
 $app = AppFactory::create();
+
+// ROUTE_PREFIX (e.g. /forwarder) mounts every route, events included, under a sub-path
+// for ingresses that don't strip it; bare paths then 404
+$routePrefix = trim((string) env('ROUTE_PREFIX', ''), '/');
+$app->setBasePath($routePrefix === '' ? '' : '/' . $routePrefix);
+
+// Tag each request with an ID, honouring a sane X-Request-Id from upstream proxies, and
+// echo it back so a dropped event can be traced through the logs and to Sentry
+$app->add(function (Request $request, RequestHandler $handler) {
+    $id = $request->getHeaderLine('X-Request-Id');
+
+    if (!preg_match('/^[A-Za-z0-9._-]{1,128}$/', $id)) {
+        $id = bin2hex(random_bytes(16));
+    }
+
+    requestId($id);
+
+    return $handler->handle($request->withAttribute('request_id', $id))->withHeader('X-Request-Id', $id);
+});
+
+// Compress responses for clients that accept gzip, once they're worth it; SDK acks are
+// tiny, but relayed upstream error pages can be large
+$app->add(function (Request $request, RequestHandler $handler) {
+    $response = $handler->handle($request);
+
+    if (!acceptsGzip($request->getHeaderLine('Accept-Encoding')) || $response->hasHeader('Content-Encoding')) {
+        return $response;
+    }
+
+    $body = (string) $response->getBody();
+
+    if (strlen($body) < (int) env('RESPONSE_GZIP_MIN_SIZE', 1024)) {
+        return $response->withBody(Utils::streamFor($body));
+    }
+
+    return $response
+        ->withBody(Utils::streamFor(gzencode($body, 1)))
+        ->withHeader('Content-Encoding', 'gzip')
+        ->withAddedHeader('Vary', 'Accept-Encoding')
+        ->withoutHeader('Content-Length');
+});
+
 $app->addRoutingMiddleware();
-$errorMiddleware = $app->addErrorMiddleware(false, false, false);
 
-// Configuration
-$mappings = $data = Yaml::parseFile('../config.yaml')['dsn_mapping'];
+// Browser SDKs using the forwarder as a tunnel need CORS: answer preflights here, ahead
+// of routing, and label every other response for origins in CORS_ALLOWED_ORIGINS
+$app->add(function (Request $request, RequestHandler $handler) use ($app) {
+    $origin = corsOrigin($request);
 
-function getOldKey($headerValue)
-{
-    $headerParts = explode(',', $headerValue);
-    $values = [];
+    if ($request->getMethod() !== 'OPTIONS') {
+        return withCorsHeaders($handler->handle($request), $origin);
+    }
 
-    foreach ($headerParts as $part) {
-        list($key, $value) = explode('=', trim($part), 2);
-        $values[trim($key)] = trim($value, '"');
+    $response = $app->getResponseFactory()->createResponse(204);
+
+    if (!is_null($origin)) {
+        $response = $response
+            ->withHeader('Access-Control-Allow-Methods', 'POST, OPTIONS')
+            ->withHeader('Access-Control-Allow-Headers', $request->getHeaderLine('Access-Control-Request-Headers') ?: 'Content-Type, X-Sentry-Auth')
+            ->withHeader('Access-Control-Max-Age', '86400');
     }
 
-    return $values['sentry_key'];
+    return withCorsHeaders($response, $origin);
+});
+
+$errorMiddleware = $app->addErrorMiddleware(false, false, false);
+
+// Sentry ingest only takes POST; say so in JSON like every other error, CORS preflights included
+$errorMiddleware->setErrorHandler(HttpMethodNotAllowedException::class, function (Request $request, HttpMethodNotAllowedException $exception) use ($app) {
+    $allowed = array_unique(array_merge($exception->getAllowedMethods(), ['OPTIONS']));
+
+    return errorResponse($app->getResponseFactory()->createResponse(), 405, 'method not allowed')
+        ->withHeader('Allow', implode(', ', $allowed));
+});
+
+// Configuration. A broken config doesn't stop the app: loadConfig() keeps serving the last
+// good copy, and without one /healthz stays up, /readyz reports the problem and events are
+// refused until the config is fixed.
+$configError = null;
+$forwarder = null;
+$mappings = null;
+
+try {
+    $config = expandEnv(loadConfig(env('CONFIG_PATH', __DIR__ . '/../config.yaml')));
+    $problems = validateConfig($config);
+} catch (Exception $e) {
+    $problems = [$e->getMessage()];
 }
 
-function getMapping($oldKey, $mappings)
-{
-    foreach ($mappings as $mapping) {
-        $oldURI = parse_url($mapping['old']);
-
-        if ($oldURI['user'] === $oldKey) {
-            return [
-                'old_uri' => $oldURI,
-                'new_uri' => parse_url($mapping['new']),
-                'old_dsn' => $mapping['old'],
-                'new_dsn' => $mapping['new'],
-            ];
+if ($problems) {
+    logEvent('error', 'Invalid config', ['problems' => $problems]);
+
+    $configError = 'invalid forwarder config';
+} else {
+    $profile = selectProfile($config, env('CONFIG_PROFILE'), $_SERVER['SERVER_PORT'] ?? null);
+
+    if (is_null($profile)) {
+        logEvent('error', 'No config profile for this listener', ['profile' => env('CONFIG_PROFILE'), 'port' => $_SERVER['SERVER_PORT'] ?? null]);
+
+        $configError = 'no forwarder config profile for this listener';
+    } else {
+        // Upstream client, built once and shared by every forward. Its TLS and proxy settings
+        // can be broken too (e.g. an unreadable FORWARD_CA_FILE), which /readyz reports
+        try {
+            $forwarder = new Forwarder($profile, forwardClient(), $app->getResponseFactory());
+            $mappings = $forwarder->mappings();
+        } catch (Exception $e) {
+            logEvent('error', 'Unable to set up the upstream client', ['error' => $e->getMessage()]);
+
+            $configError = 'invalid upstream client settings';
         }
     }
-
-    return null;
 }
 
-function convertPayload($payload, $mapping)
-{
-    $payload = (gzdecode($payload));
+// A config with nothing to forward is almost always a mistake, so it counts as broken
+// unless ALLOW_EMPTY_CONFIG says it is on purpose (e.g. while mappings are being staged)
+if (is_null($configError) && !$mappings['by_key'] && !$mappings['by_project'] && is_null($mappings['default'])) {
+    if (filter_var(env('ALLOW_EMPTY_CONFIG', 'false'), FILTER_VALIDATE_BOOLEAN)) {
+        logEvent('warn', 'Config has no enabled dsn mappings, every event will be rejected as unknown');
+    } else {
+        logEvent('error', 'Config has no enabled dsn mappings');
 
-    $escapedOldDSN = str_replace('/', '\/', $mapping['old_dsn']);
-    $escapedNewDSN = str_replace('/', '\/', $mapping['new_dsn']);
+        $configError = 'no enabled dsn mappings';
+    }
+}
 
-    $payload = str_replace($escapedOldDSN, $escapedNewDSN, $payload);
-    $payload = str_replace($mapping['old_uri']['user'], $mapping['new_uri']['user'], $payload);
+$app->get('/healthz', function (Request $request, Response $response) {
+    $response->getBody()->write(json_encode(['status' => 'ok']));
+    return $response->withHeader('Content-Type', 'application/json');
+});
 
-    return gzencode($payload);
-}
+$app->get('/version', function (Request $request, Response $response) {
+    $response->getBody()->write(json_encode(buildInfo(), JSON_UNESCAPED_SLASHES));
+    return $response->withHeader('Content-Type', 'application/json');
+});
 
-$app->post('/{path:.*}', function (Request $request, Response $response) use ($mappings) {
-    $client = new Client();
+// Ready once a valid config with at least one enabled mapping is loaded. A config that
+// stops parsing keeps serving the last good copy, so a bad edit doesn't flip this.
+$app->get('/readyz', function (Request $request, Response $response) use ($configError) {
+    if (!is_null($configError)) {
+        return errorResponse($response, 503, $configError);
+    }
 
-    $oldKey = getOldKey($request->getHeaderLine('X-Sentry-Auth'));
-    $mapping = getMapping($oldKey, $mappings);
+    $response->getBody()->write(json_encode(['status' => 'ready']));
+    return $response->withHeader('Content-Type', 'application/json');
+});
 
-    if (is_null($mapping)) {
-        error_log("Unknown old sentry DSN key: " . $oldKey);
+// What a running instance actually loaded, for support. Set DEBUG_TOKEN to require it
+// as a bearer token
+$app->get('/debug/info', function (Request $request, Response $response) use ($mappings, $configError) {
+    $token = env('DEBUG_TOKEN');
 
-        $response->getBody()->write(json_encode(['error' => 'unknown DSN for forwarding']));
-        return $response->withStatus(500)->withHeader('Content-Type', 'application/json');
+    if (!is_null($token) && !hasBearerToken($request, $token)) {
+        return errorResponse($response, 401, 'debug token required');
     }
 
-    $headers = [];
+    $summary = is_null($mappings) ? [] : configSummary($mappings);
+
+    $response->getBody()->write(json_encode([
+        'version' => buildInfo()['version'],
+        'config_error' => $configError,
+        'mapping_count' => count($summary),
+        'mappings' => $summary,
+    ], JSON_UNESCAPED_SLASHES));
+    return $response->withHeader('Content-Type', 'application/json');
+});
 
-    foreach ($request->getHeaders() as $key => $value) {
-        $headers[$key] = $value[0];
+// Operator tools for "why isn't my event forwarded?". They are off unless ADMIN_TOKEN is
+// set, and then require it as a bearer token
+$app->group('/admin', function (RouteCollectorProxy $group) use ($mappings) {
+    // Each mapping with, per new DSN, when a forward last succeeded and last failed
+    $group->get('/mappings', function (Request $request, Response $response) use ($mappings) {
+        $response->getBody()->write(json_encode(['mappings' => configSummary($mappings, true)], JSON_UNESCAPED_SLASHES));
+        return $response->withHeader('Content-Type', 'application/json');
+    });
+
+    // Resolves ?key= (and optionally ?project=) as an event would be, without forwarding anything
+    $group->get('/test', function (Request $request, Response $response) use ($mappings) {
+        $query = $request->getQueryParams();
+        $key = ($query['key'] ?? '') === '' ? null : $query['key'];
+        $project = ($query['project'] ?? '') === '' ? null : $query['project'];
+        $match = mappingMatch($key, $project, $mappings);
+
+        $response->getBody()->write(json_encode([
+            'matched_by' => $match,
+            'mapping' => is_null($match) ? null : mappingSummary(getMapping($key, $project, $mappings)),
+        ], JSON_UNESCAPED_SLASHES));
+        return $response->withHeader('Content-Type', 'application/json');
+    });
+})->add(function (Request $request, RequestHandler $handler) use ($app, $mappings) {
+    $token = env('ADMIN_TOKEN');
+    $response = $app->getResponseFactory()->createResponse();
+
+    if (is_null($token)) {
+        return errorResponse($response, 404, 'admin endpoints are disabled');
     }
 
-    $headers['X-Sentry-Auth'] = str_replace($mapping['old_uri']['user'], $mapping['new_uri']['user'], $headers['X-Sentry-Auth']);
-    $headers['Host'] = $mapping['new_uri']['host'];
+    if (!hasBearerToken($request, $token)) {
+        return errorResponse($response, 401, 'admin token required');
+    }
 
-    $newUrl = $mapping['new_uri']['scheme'] . '://' . $mapping['new_uri']['host'] . '/api' . $mapping['new_uri']['path'] . '/envelope/';
+    if (is_null($mappings)) {
+        return errorResponse($response, 503, 'no valid config loaded');
+    }
 
-    // Log the full request URI and the new URL (optional)
-    error_log("Forwarding from " . $mapping['old_dsn'] . " to " . $mapping['new_dsn']);
+    return $handler->handle($request);
+});
 
-    // Get the JSON body from the incoming request
-    $data = $request->getBody()->getContents();
+$app->get('/metrics', function (Request $request, Response $response) {
+    $response->getBody()->write(renderMetrics());
+    return $response->withHeader('Content-Type', 'text/plain; version=0.0.4');
+});
 
-    // Forward the request to the new Sentry DSN
-    try {
-        $res = $client->request('POST', $newUrl, [
-            'body' => convertPayload($data, $mapping),
-            'headers' => $headers,
-        ]);
+// Events may be posted to any path but the service routes above, which answer POST with a 405
+$app->post('/{path:(?!(?:healthz|readyz|version|metrics|debug/info|admin(?:/.*)?)$).*}', function (Request $request, Response $response, array $args) use ($forwarder, $configError) {
+    if (!is_null($configError)) {
+        incrementCounter('sentry_forwarder_events_received_total');
 
-        // Respond with the status and body from the new Sentry DSN
-        $response->getBody()->write($res->getBody()->getContents());
-        return $response->withStatus($res->getStatusCode())->withHeader('Content-Type', 'application/json');
-    } catch (Exception $e) {
-        // Handle exceptions
-        $response->getBody()->write(json_encode(['error' => $e->getMessage()]));
-        return $response->withStatus(500)->withHeader('Content-Type', 'application/json');
+        return errorResponse($response, 500, $configError);
     }
+
+    return $forwarder->handle($request->withAttribute('path', $args['path']));
 });
 
 $app->run();
@@ -0,0 +1,295 @@
+<?php
+
+namespace SentryForwarder;
+
+use EnvelopeFilteredException;
+use Exception;
+use GuzzleHttp\Client;
+use GuzzleHttp\Exception\GuzzleException;
+use GuzzleHttp\Psr7\HttpFactory;
+use GuzzleHttp\Psr7\Response as Psr7Response;
+use InvalidArgumentException;
+use PayloadException;
+use Psr\Http\Message\ResponseFactoryInterface;
+use Psr\Http\Message\ResponseInterface as Response;
+use Psr\Http\Message\ServerRequestInterface as Request;
+use Psr\Http\Server\RequestHandlerInterface;
+use RuntimeException;
+
+require_once __DIR__ . '/config.php';
+require_once __DIR__ . '/client.php';
+require_once __DIR__ . '/metrics.php';
+require_once __DIR__ . '/spool.php';
+require_once __DIR__ . '/forwarding.php';
+
+/**
+ * Rewrites and forwards Sentry events per a config's dsn_mapping, as a PSR-15 handler, so
+ * the forwarder can be mounted in any PSR-15 app and not only public/index.php. Settings
+ * other than the mappings still come from the environment.
+ */
+class Forwarder implements RequestHandlerInterface
+{
+    private $mappings;
+    private $client;
+    private $responseFactory;
+    private $rewriteHook;
+
+    /**
+     * Throws InvalidArgumentException listing the problems when the config is invalid.
+     */
+    public function __construct(array $config, ?Client $client = null, ?ResponseFactoryInterface $responseFactory = null)
+    {
+        $problems = validateConfig($config);
+
+        if ($problems) {
+            throw new InvalidArgumentException('Invalid forwarder config: ' . implode('; ', $problems));
+        }
+
+        $this->mappings = buildMappings($config['dsn_mapping']);
+        $this->client = $client ?? forwardClient();
+        $this->responseFactory = $responseFactory ?? new HttpFactory();
+    }
+
+    /**
+     * Registers a hook to modify envelopes in flight, e.g. to scrub PII or add tags during a
+     * migration. It runs once the envelope points at the new DSN and before recompression,
+     * gets the envelope header and the items, each a `header` object and a `payload`
+     * string, and returns both as [$header, $items]. Pass null to remove it.
+     */
+    public function setRewriteHook(?callable $hook)
+    {
+        $this->rewriteHook = $hook;
+    }
+
+    /**
+     * The mapping index built by buildMappings().
+     */
+    public function mappings()
+    {
+        return $this->mappings;
+    }
+
+    /**
+     * The event path is taken from the request's `path` attribute when set, as routers that
+     * mount the forwarder under a prefix should do, and from the URI path otherwise.
+     */
+    public function handle(Request $request): Response
+    {
+        $response = $this->responseFactory->createResponse();
+        $path = $request->getAttribute('path', ltrim($request->getUri()->getPath(), '/'));
+
+        incrementCounter('sentry_forwarder_events_received_total');
+
+        // Without an allowlist the forwarder is an open relay for anyone who knows a key
+        $allowed = envList('ALLOWED_CIDRS');
+
+        if ($allowed && !ipInList(clientIp($request), $allowed)) {
+            logEvent('warn', 'Client not allowed', ['client_ip' => clientIp($request)]);
+
+            return errorResponse($response, 403, 'client not allowed');
+        }
+
+        if (is_null(getEndpoint($path))) {
+            logEvent('warn', 'Unsupported Sentry endpoint', ['path' => $path]);
+
+            return errorResponse($response, 404, 'unsupported Sentry endpoint');
+        }
+
+        $oldKey = getOldKey($request->getHeaderLine('X-Sentry-Auth'));
+        $query = $request->getQueryParams();
+
+        // Tunnels and older SDKs pass the key in the query string instead of the auth header
+        if (empty($oldKey) && !empty($query['sentry_key'])) {
+            $oldKey = $query['sentry_key'];
+        }
+
+        $mapping = getMapping($oldKey, getProjectId($path), $this->mappings);
+
+        if (is_null($mapping)) {
+            logEvent('warn', 'Unknown old sentry DSN key', ['old_key' => $oldKey, 'client_ip' => clientIp($request)]);
+            incrementCounter('sentry_forwarder_unknown_dsn_total');
+
+            // A misconfigured SDK retries every non-2xx answer, so QUIET_REJECT accepts and discards instead
+            if (filter_var(env('QUIET_REJECT', 'false'), FILTER_VALIDATE_BOOLEAN)) {
+                return successResponse($response, null);
+            }
+
+            return errorResponse($response, 400, 'unknown DSN for forwarding');
+        }
+
+        // Sentry itself caps envelopes at 20 MiB; unless set, the same cap applies once
+        // decompressed. A mapping's max_decompressed_bytes overrides the global cap
+        $maxBodySize = (int) env('MAX_BODY_SIZE', 20 * 1024 * 1024);
+        $maxDecompressedSize = (int) ($mapping['max_decompressed_bytes'] ?? env('MAX_DECOMPRESSED_SIZE', $maxBodySize));
+
+        if ((int) $request->getHeaderLine('Content-Length') > $maxBodySize) {
+            return errorResponse($response, 413, 'request body too large');
+        }
+
+        $stream = $request->getBody();
+        $magic = $stream->read(2);
+        $stream->rewind();
+
+        $encoding = detectEncoding($magic, $request->getHeaderLine('Content-Encoding'));
+
+        // Probes and SDK pings may POST nothing at all, which can't be decompressed. PHP hands
+        // multipart bodies over pre-parsed, so their stream always reads empty
+        if ($magic === '' && !isMultipart($request)) {
+            if (env('EMPTY_BODY_MODE', 'forward') === 'ack') {
+                logEvent('debug', 'Acknowledged empty body', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+                return successResponse($response, null);
+            }
+
+            $encoding = 'identity';
+        }
+
+        // Accept as Sentry would, so SDKs don't retry, but spend no upstream quota
+        if ($mapping['mode'] === 'drop') {
+            logEvent('debug', 'Dropped event', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+            incrementCounter('sentry_forwarder_events_dropped_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+            return successResponse($response, envelopeEventId($request, $encoding, $maxDecompressedSize));
+        }
+
+        if ($mapping['sample_rate'] < 1) {
+            $eventId = envelopeEventId($request, $encoding, $maxDecompressedSize);
+
+            if (!sampleEvent($eventId, $mapping['sample_rate'])) {
+                logEvent('debug', 'Sampled out event', ['old_dsn' => dsnLabel($mapping['old_uri']), 'event_id' => $eventId]);
+                incrementCounter('sentry_forwarder_events_sampled_out_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+                return successResponse($response, $eventId);
+            }
+        }
+
+        // Per old DSN events/second, with `burst` events allowed at once
+        if (!is_null($mapping['rate_limit'])) {
+            $rate = (float) $mapping['rate_limit']['rate'];
+            $wait = takeRateToken($mapping['old_dsn'], $rate, (float) ($mapping['rate_limit']['burst'] ?? max(1, ceil($rate))));
+
+            if ($wait > 0) {
+                logEvent('warn', 'Rate limited', ['old_dsn' => dsnLabel($mapping['old_uri']), 'client_ip' => clientIp($request)]);
+                incrementCounter('sentry_forwarder_rate_limited_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+                return errorResponse($response, 429, 'rate limit exceeded')->withHeader('Retry-After', (string) ceil($wait));
+            }
+        }
+
+        // With ASYNC_FORWARD, events are acknowledged once spooled and bin/spool-worker delivers
+        // them, so it must be running (the image starts it whenever SPOOL_DIR is set). Multipart
+        // bodies can't be spooled, so those are still forwarded in-line
+        $async = filter_var(env('ASYNC_FORWARD', 'false'), FILTER_VALIDATE_BOOLEAN) && !is_null(env('SPOOL_DIR')) && !isMultipart($request);
+
+        if ($async && spoolFull()) {
+            logEvent('warn', 'Forward queue full', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+            return errorResponse($response, 429, 'forward queue full')->withHeader('Retry-After', '1');
+        }
+
+        $slot = null;
+        $maxConcurrent = (int) env('MAX_CONCURRENT_FORWARDS', 0);
+
+        if ($maxConcurrent > 0 && !$async) {
+            $slot = acquireForwardSlot($maxConcurrent, (float) env('FORWARD_SLOT_TIMEOUT', 5));
+
+            if (is_null($slot)) {
+                logEvent('warn', 'Forward throttled', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+                return errorResponse($response, 503, 'too many concurrent forwards')->withHeader('Retry-After', '1');
+            }
+        }
+
+        // Forward the request to each new Sentry DSN
+        try {
+            // Passthrough targets need no buffer at all. A rewrite hook sees every envelope, so
+            // nothing is passed through while one is set
+            $passthrough = $mapping['passthrough'] && is_null($this->rewriteHook);
+
+            // Multipart and declared-length plain bodies are rebuilt per target rather than buffered,
+            // unless their items have to be parsed
+            $parseItems = $mapping['rewrite_payload_dsn'] || !is_null($mapping['item_types']) || !is_null($this->rewriteHook);
+            $buffered = !isMultipart($request) && !$passthrough && (!($encoding === 'identity' && $request->hasHeader('Content-Length')) || $parseItems);
+            $data = $buffered ? readBody($stream, $maxBodySize) : null;
+            $results = [];
+
+            foreach ($mapping['targets'] as $target) {
+                $target = array_merge($mapping, $target, ['rewrite_hook' => $this->rewriteHook]);
+                $target['passthrough'] = $target['passthrough'] && is_null($this->rewriteHook);
+                list($url, $options, $sizes) = buildForward($request, $target, $path, $encoding, $data, $maxDecompressedSize);
+
+                if ($async) {
+                    $results[] = spoolForward($url, $options, $target)
+                        ? new Psr7Response(200, ['Content-Type' => 'application/json'], sentryAck(envelopeEventId($request, $encoding, $maxDecompressedSize)))
+                        : new RuntimeException('Unable to queue forward');
+                    continue;
+                }
+
+                if (!breakerAllows($target['new_dsn'])) {
+                    // Fail fast while the upstream is known to be down; spooled below if possible
+                    logEvent('warn', 'Circuit open, forward skipped', ['new_dsn' => dsnLabel($target['new_uri'])]);
+
+                    $result = new Psr7Response(503, ['Content-Type' => 'application/json', 'Retry-After' => env('BREAKER_COOLDOWN', '30')], json_encode(['error' => 'upstream circuit open']));
+                } else {
+                    try {
+                        $result = sendForward($this->client, $url, $options, $target, $sizes);
+                    } catch (GuzzleException $e) {
+                        logEvent('error', 'Forward failed', [
+                            'old_dsn' => dsnLabel($target['old_uri']),
+                            'new_dsn' => dsnLabel($target['new_uri']),
+                            'event_id' => $sizes['event_id'] ?? null,
+                            'error' => $e->getMessage(),
+                        ]);
+
+                        $result = $e;
+                    }
+
+                    recordBreakerResult($target['new_dsn'], isForwardFailure($result));
+                    recordForwardStatus($target, $result instanceof Exception
+                        ? $result->getMessage()
+                        : ($result->getStatusCode() >= 400 ? 'upstream responded ' . $result->getStatusCode() : null));
+                }
+
+                if (isForwardFailure($result) && spoolForward($url, $options, $target)) {
+                    // Accepted for later delivery, so the SDK must not retry it
+                    $result = new Psr7Response(200, ['Content-Type' => 'application/json'], sentryAck(envelopeEventId($request, $encoding, $maxDecompressedSize)));
+                }
+
+                $results[] = $result;
+            }
+
+            $result = pickFanoutResult($results, $mapping['fanout']);
+
+            if ($result instanceof Exception) {
+                return errorResponse($response, upstreamErrorStatus($result), $result->getMessage());
+            }
+
+            return relayResponse($response, $result);
+        } catch (EnvelopeFilteredException $e) {
+            logEvent('debug', 'Filtered out event', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+            incrementCounter('sentry_forwarder_events_filtered_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+            return successResponse($response, envelopeEventId($request, $encoding, $maxDecompressedSize));
+        } catch (PayloadException $e) {
+            logEvent('warn', 'Payload rejected', [
+                'old_dsn' => dsnLabel($mapping['old_uri']),
+                'reason' => $e->reason,
+                'error' => $e->getMessage(),
+                'request_size' => $request->getHeaderLine('Content-Length'),
+            ]);
+
+            incrementCounter('sentry_forwarder_payload_errors_total', ['reason' => $e->reason]);
+
+            return errorResponse($response, $e->status, $e->getMessage());
+        } catch (Exception $e) {
+            logEvent('error', 'Forward failed', [
+                'old_dsn' => dsnLabel($mapping['old_uri']),
+                'error' => $e->getMessage(),
+            ]);
+
+            return errorResponse($response, 500, $e->getMessage());
+        } finally {
+            releaseForwardSlot($slot);
+        }
+    }
+}
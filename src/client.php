@@ -0,0 +1,146 @@
+<?php
+
+// The upstream HTTP client, shared by the web app and bin/spool-worker
+
+use GuzzleHttp\Client;
+use GuzzleHttp\Exception\ConnectException;
+use GuzzleHttp\Exception\RequestException;
+use GuzzleHttp\HandlerStack;
+use GuzzleHttp\Middleware;
+
+/**
+ * Retries connection failures and 502/503/504 responses; other 4xx/5xx are final.
+ */
+function retryDecider($maxAttempts)
+{
+    return function ($retries, $request, $response = null, $exception = null) use ($maxAttempts) {
+        if ($retries + 1 >= $maxAttempts) {
+            return false;
+        }
+
+        if ($exception instanceof ConnectException) {
+            return true;
+        }
+
+        return !is_null($response) && in_array($response->getStatusCode(), [502, 503, 504], true);
+    };
+}
+
+/**
+ * Exponential backoff with full jitter, in milliseconds.
+ */
+function retryDelay($baseDelay)
+{
+    return function ($retries) use ($baseDelay) {
+        return random_int(0, $baseDelay * 2 ** ($retries - 1));
+    };
+}
+
+/**
+ * FORWARD_PROXY_URL forces one proxy for every forward; otherwise the usual HTTP_PROXY,
+ * HTTPS_PROXY and NO_PROXY apply. These are read from the process environment only
+ * (getenv's local_only), so a client's "Proxy:" request header can never set them.
+ */
+function proxyConfig()
+{
+    $override = env('FORWARD_PROXY_URL');
+
+    if (!is_null($override)) {
+        return $override;
+    }
+
+    $proxy = [];
+
+    foreach (['http' => 'HTTP_PROXY', 'https' => 'HTTPS_PROXY', 'no' => 'NO_PROXY'] as $key => $name) {
+        $value = getenv($name, true) ?: getenv(strtolower($name), true);
+
+        if ($value) {
+            $proxy[$key] = $key === 'no' ? array_map('trim', explode(',', $value)) : $value;
+        }
+    }
+
+    return isset($proxy['http']) || isset($proxy['https']) ? $proxy : null;
+}
+
+/**
+ * Upstream redirects are not followed by default: the 3xx goes back to the SDK, since
+ * following one could hand X-Sentry-Auth, which Guzzle doesn't strip, to another host.
+ * FORWARD_REDIRECTS=same-host follows them, POST and body intact, as long as they stay on
+ * the same host and don't downgrade https to http; any other redirect fails the forward.
+ */
+function redirectConfig()
+{
+    if (env('FORWARD_REDIRECTS', 'none') !== 'same-host') {
+        return false;
+    }
+
+    return [
+        'max' => 5,
+        'strict' => true,
+        'referer' => false,
+        'protocols' => ['http', 'https'],
+        'on_redirect' => function ($request, $response, $uri) {
+            $from = $request->getUri();
+
+            if (strcasecmp($uri->getHost(), $from->getHost()) !== 0 || ($from->getScheme() === 'https' && $uri->getScheme() !== 'https')) {
+                throw new RequestException('Refusing upstream redirect to ' . $uri->getScheme() . '://' . $uri->getHost(), $request, $response);
+            }
+        },
+    ];
+}
+
+/**
+ * FORWARD_CA_FILE adds a CA bundle, e.g. for a self-hosted Sentry behind a private CA, on
+ * top of the system's; Guzzle only takes one bundle, so the two are combined in the temp
+ * dir. FORWARD_INSECURE_SKIP_VERIFY=true turns verification off, for test setups only.
+ */
+function tlsVerify()
+{
+    if (filter_var(env('FORWARD_INSECURE_SKIP_VERIFY', 'false'), FILTER_VALIDATE_BOOLEAN)) {
+        return false;
+    }
+
+    $caFile = env('FORWARD_CA_FILE');
+
+    if (is_null($caFile)) {
+        return true;
+    }
+
+    if (!is_readable($caFile)) {
+        throw new RuntimeException('FORWARD_CA_FILE is not readable: ' . $caFile);
+    }
+
+    $system = openssl_get_cert_locations()['default_cert_file'] ?? null;
+    $bundle = sys_get_temp_dir() . '/sentry-forwarder-ca-' . md5($caFile . filemtime($caFile)) . '.pem';
+
+    if (!is_file($bundle)) {
+        $certs = (is_readable((string) $system) ? file_get_contents($system) . "\n" : '') . file_get_contents($caFile);
+        file_put_contents($bundle . '.tmp', $certs);
+        rename($bundle . '.tmp', $bundle);
+    }
+
+    return $bundle;
+}
+
+/**
+ * The upstream client, retrying as retryDecider() and retryDelay() describe.
+ */
+function forwardClient()
+{
+    $handler = HandlerStack::create();
+    $handler->push(Middleware::retry(
+        retryDecider((int) env('FORWARD_MAX_ATTEMPTS', 3)),
+        retryDelay((int) env('FORWARD_RETRY_DELAY_MS', 200))
+    ));
+
+    return new Client([
+        'handler' => $handler,
+        'timeout' => (float) env('FORWARD_TIMEOUT', 30),
+        'connect_timeout' => (float) env('FORWARD_CONNECT_TIMEOUT', 10),
+        // Upstream errors and rate limits are relayed to the SDK as-is
+        'http_errors' => false,
+        'proxy' => proxyConfig(),
+        'verify' => tlsVerify(),
+        'allow_redirects' => redirectConfig(),
+    ]);
+}
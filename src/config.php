@@ -0,0 +1,423 @@
+<?php
+
+// Config loading and validation, shared by the web app and bin/validate-config
+
+use GuzzleHttp\Client;
+use GuzzleHttp\Exception\GuzzleException;
+use Symfony\Component\Yaml\Yaml;
+
+function env($name, $default = null)
+{
+    $value = getenv($name);
+
+    return $value === false || $value === '' ? $default : $value;
+}
+
+const LOG_LEVELS = ['debug' => 0, 'info' => 1, 'warn' => 2, 'error' => 3];
+
+/**
+ * Holds the ID of the request being served, so every log line can carry it.
+ */
+function requestId($id = null)
+{
+    static $current = null;
+
+    if (!is_null($id)) {
+        $current = $id;
+    }
+
+    return $current;
+}
+
+/**
+ * Writes one JSON object per line to stderr, skipping levels below LOG_LEVEL.
+ */
+function logEvent($level, $message, $fields = [])
+{
+    $threshold = LOG_LEVELS[strtolower(env('LOG_LEVEL', 'info'))] ?? LOG_LEVELS['info'];
+
+    if (LOG_LEVELS[$level] < $threshold) {
+        return;
+    }
+
+    $record = ['time' => date(DATE_RFC3339_EXTENDED), 'level' => $level, 'msg' => $message] + $fields;
+
+    if (!is_null(requestId())) {
+        $record['request_id'] = requestId();
+    }
+
+    file_put_contents('php://stderr', json_encode($record, JSON_UNESCAPED_SLASHES) . "\n");
+}
+
+/**
+ * The config is re-read on every request, so edits apply without a restart. A config
+ * that fails to parse or validate falls back to the last one that passed both, instead
+ * of failing every event; only such configs are kept as the last good copy.
+ *
+ * The path may also be an http(s):// URL. Fetched configs are reused for
+ * CONFIG_CACHE_TTL seconds, and a failed fetch falls back to the last good copy too.
+ * Pass $fallback = false to skip the cache and surface load errors instead, as the
+ * validator does.
+ */
+function loadConfig($path, $fallback = true)
+{
+    $cachePath = sys_get_temp_dir() . '/sentry-forwarder-config-' . md5($path) . '.json';
+    $remote = preg_match('#^https?://#i', $path) === 1;
+
+    // Without the fallback the caller wants what the server serves now, not a cached copy
+    if ($fallback && $remote && is_file($cachePath) && time() - filemtime($cachePath) < (int) env('CONFIG_CACHE_TTL', 60)) {
+        return json_decode(file_get_contents($cachePath), true);
+    }
+
+    if (!$remote && !is_file($path)) {
+        throw new RuntimeException("Config file not found: " . $path);
+    }
+
+    try {
+        $config = $remote ? fetchConfig($path) : Yaml::parseFile($path);
+    } catch (RuntimeException | GuzzleException $e) {
+        $cached = $fallback && is_file($cachePath) ? json_decode(file_get_contents($cachePath), true) : null;
+
+        if (is_null($cached)) {
+            throw $e;
+        }
+
+        logEvent('warn', 'Unable to load config, using last known good copy', ['path' => $path, 'error' => $e->getMessage()]);
+
+        // Don't hit an unreachable config server again until the TTL has passed
+        if ($remote) {
+            touch($cachePath);
+        }
+
+        return $cached;
+    }
+
+    try {
+        $problems = validateConfig(expandEnv($config));
+    } catch (RuntimeException $e) {
+        $problems = [$e->getMessage()];
+    }
+
+    // The caller validates again and reports the problems when there is nothing to fall back to
+    if ($problems) {
+        $cached = $fallback && is_file($cachePath) ? json_decode(file_get_contents($cachePath), true) : null;
+
+        if (is_null($cached)) {
+            return $config;
+        }
+
+        logEvent('warn', 'Invalid config, using last known good copy', ['path' => $path, 'problems' => $problems]);
+
+        if ($remote) {
+            touch($cachePath);
+        }
+
+        return $cached;
+    }
+
+    if ($remote || !is_file($cachePath) || filemtime($cachePath) < filemtime($path)) {
+        file_put_contents($cachePath, json_encode($config), LOCK_EX);
+    }
+
+    return $config;
+}
+
+function fetchConfig($url)
+{
+    $client = new Client(['timeout' => (float) env('CONFIG_FETCH_TIMEOUT', 5)]);
+
+    return Yaml::parse($client->get($url)->getBody()->getContents());
+}
+
+/**
+ * Expands ${VAR} in the `old` and `new` DSNs from the environment, so keys needn't be
+ * committed with the config. A variable that isn't set is an error rather than a blank.
+ */
+function expandEnv($config, $prefix = '')
+{
+    foreach (isset($config['profiles']) && is_array($config['profiles']) ? $config['profiles'] : [] as $name => $profile) {
+        $config['profiles'][$name] = is_array($profile) ? expandEnv($profile, "profiles.$name.") : $profile;
+    }
+
+    foreach (isset($config['dsn_mapping']) && is_array($config['dsn_mapping']) ? $config['dsn_mapping'] : [] as $i => $mapping) {
+        foreach (['old', 'new'] as $field) {
+            if (!is_array($mapping) || !isset($mapping[$field])) {
+                continue;
+            }
+
+            foreach ((array) $mapping[$field] as $j => $dsn) {
+                $name = $prefix . "dsn_mapping[$i].$field" . (is_array($mapping[$field]) ? "[$j]" : '');
+                $expanded = expandEnvString($dsn, $name);
+
+                if (is_array($mapping[$field])) {
+                    $config['dsn_mapping'][$i][$field][$j] = $expanded;
+                } else {
+                    $config['dsn_mapping'][$i][$field] = $expanded;
+                }
+            }
+        }
+    }
+
+    return $config;
+}
+
+function expandEnvString($value, $name)
+{
+    if (!is_string($value)) {
+        return $value;
+    }
+
+    return preg_replace_callback('/\$\{([A-Za-z_][A-Za-z0-9_]*)\}/', function ($matches) use ($name) {
+        $value = getenv($matches[1]);
+
+        if ($value === false) {
+            throw new RuntimeException("$name: environment variable {$matches[1]} is not set");
+        }
+
+        return $value;
+    }, $value);
+}
+
+/**
+ * A mapping's `old` is either one DSN or a list of DSNs all forwarded to the same `new`.
+ * An `old` of "*" makes the mapping the catch-all for keys that match nothing else.
+ */
+function oldDsns($mapping)
+{
+    return isset($mapping['old']) ? (array) $mapping['old'] : [];
+}
+
+/**
+ * `mode: drop`, or an explicitly empty `new`, accepts events and discards them.
+ */
+function mappingMode($mapping)
+{
+    if (isset($mapping['mode'])) {
+        return $mapping['mode'];
+    }
+
+    return array_key_exists('new', $mapping) && empty($mapping['new']) ? 'drop' : 'forward';
+}
+
+/**
+ * The project ID is the last segment of a DSN's path; anything before it is the
+ * prefix a self-hosted Sentry is mounted under, e.g. https://key@host/sentry/42.
+ */
+function splitDsnPath($uri)
+{
+    $path = trim($uri['path'] ?? '', '/');
+
+    // DSNs are sometimes copied with the full ingest path, e.g. /api/42/envelope/
+    $path = preg_replace('#(^|/)api/([^/]+)(/(envelope|store|minidump|security))?$#', '$1$2', $path);
+    $slash = strrpos($path, '/');
+
+    if ($slash === false) {
+        return ['', $path];
+    }
+
+    return ['/' . substr($path, 0, $slash), substr($path, $slash + 1)];
+}
+
+function validateDsn($dsn, $name)
+{
+    $uri = is_string($dsn) ? parse_url($dsn) : false;
+
+    if ($uri === false || empty($uri['scheme']) || empty($uri['host'])) {
+        return ["$name: not a valid DSN URL"];
+    }
+
+    $problems = [];
+
+    if (empty($uri['user'])) {
+        $problems[] = "$name: missing public key";
+    }
+
+    if (splitDsnPath($uri)[1] === '') {
+        $problems[] = "$name: missing project ID";
+    }
+
+    return $problems;
+}
+
+/**
+ * A config may hold named `profiles`, each with its own `port` and `dsn_mapping`, so one
+ * file can serve several listeners (one `php -S` per port). CONFIG_PROFILE picks a
+ * profile by name; otherwise the port the request came in on does. A config without
+ * profiles is returned as it is.
+ */
+function selectProfile($config, $name, $port)
+{
+    if (!isset($config['profiles'])) {
+        return $config;
+    }
+
+    if (!is_null($name)) {
+        return $config['profiles'][$name] ?? null;
+    }
+
+    foreach ($config['profiles'] as $profile) {
+        if (isset($profile['port']) && (string) $profile['port'] === (string) $port) {
+            return $profile;
+        }
+    }
+
+    return null;
+}
+
+function validateConfig($config)
+{
+    if (isset($config['profiles'])) {
+        return validateProfiles($config['profiles']);
+    }
+
+    if (!isset($config['dsn_mapping']) || !is_array($config['dsn_mapping'])) {
+        return ['dsn_mapping must be a list of mappings'];
+    }
+
+    $problems = [];
+    $seen = [];
+
+    foreach ($config['dsn_mapping'] as $i => $mapping) {
+        // e.g. a bare DSN or an empty YAML item instead of an old/new pair
+        if (!is_array($mapping)) {
+            $problems[] = "dsn_mapping[$i]: must be a mapping";
+            continue;
+        }
+
+        $matchBy = $mapping['match_by'] ?? 'key';
+        $olds = oldDsns($mapping);
+
+        if (!$olds) {
+            $problems[] = "dsn_mapping[$i].old: missing";
+        }
+
+        foreach ($olds as $j => $old) {
+            $name = is_array($mapping['old']) ? "dsn_mapping[$i].old[$j]" : "dsn_mapping[$i].old";
+
+            // The catch-all entry for keys no other mapping claims
+            if ($old === '*') {
+                if (isset($seen['*']) && ($mapping['enabled'] ?? true)) {
+                    $problems[] = "$name: only one catch-all mapping is allowed, see {$seen['*']}";
+                } elseif ($mapping['enabled'] ?? true) {
+                    $seen['*'] = $name;
+                }
+
+                continue;
+            }
+            $oldProblems = validateDsn($old, $name);
+            $problems = array_merge($problems, $oldProblems);
+
+            if ($oldProblems) {
+                continue;
+            }
+
+            $uri = parse_url($old);
+            $id = $matchBy . ':' . ($matchBy === 'project' ? splitDsnPath($uri)[1] : $uri['user']);
+
+            if (!($mapping['enabled'] ?? true)) {
+                continue;
+            }
+
+            if (isset($seen[$id])) {
+                $problems[] = "$name: duplicates the $matchBy of {$seen[$id]}";
+            } else {
+                $seen[$id] = $name;
+            }
+        }
+
+        $mode = mappingMode($mapping);
+
+        if (!in_array($mode, ['forward', 'drop'], true)) {
+            $problems[] = "dsn_mapping[$i].mode: must be \"forward\" or \"drop\"";
+        } elseif ($mode === 'forward') {
+            $news = isset($mapping['new']) ? (array) $mapping['new'] : [null];
+
+            foreach ($news as $j => $new) {
+                $name = is_array($mapping['new'] ?? null) ? "dsn_mapping[$i].new[$j]" : "dsn_mapping[$i].new";
+                $problems = array_merge($problems, validateDsn($new, $name));
+            }
+        }
+
+        if (isset($mapping['fanout']) && !in_array($mapping['fanout'], ['any', 'all'], true)) {
+            $problems[] = "dsn_mapping[$i].fanout: must be \"any\" or \"all\"";
+        }
+
+        if (!in_array($matchBy, ['key', 'project'], true)) {
+            $problems[] = "dsn_mapping[$i].match_by: must be \"key\" or \"project\"";
+        }
+
+        if (isset($mapping['enabled']) && !is_bool($mapping['enabled'])) {
+            $problems[] = "dsn_mapping[$i].enabled: must be true or false";
+        }
+
+        if (isset($mapping['rate_limit'])) {
+            $limit = $mapping['rate_limit'];
+
+            if (!is_numeric($limit['rate'] ?? null) || $limit['rate'] <= 0) {
+                $problems[] = "dsn_mapping[$i].rate_limit.rate: must be a positive number of events per second";
+            }
+
+            if (isset($limit['burst']) && (!is_numeric($limit['burst']) || $limit['burst'] < 1)) {
+                $problems[] = "dsn_mapping[$i].rate_limit.burst: must be at least 1";
+            }
+        }
+
+        if (isset($mapping['sample_rate']) && (!is_numeric($mapping['sample_rate']) || $mapping['sample_rate'] < 0 || $mapping['sample_rate'] > 1)) {
+            $problems[] = "dsn_mapping[$i].sample_rate: must be between 0 and 1";
+        }
+
+        if (isset($mapping['item_types']) && (!is_array($mapping['item_types']) || !$mapping['item_types'] || array_filter($mapping['item_types'], 'is_string') !== $mapping['item_types'])) {
+            $problems[] = "dsn_mapping[$i].item_types: must be a list of envelope item types";
+        }
+
+        if (isset($mapping['max_decompressed_bytes']) && (!is_int($mapping['max_decompressed_bytes']) || $mapping['max_decompressed_bytes'] < 1)) {
+            $problems[] = "dsn_mapping[$i].max_decompressed_bytes: must be a positive number of bytes";
+        }
+
+        if (isset($mapping['path_template']) && (!is_string($mapping['path_template']) || !str_starts_with($mapping['path_template'], '/'))) {
+            $problems[] = "dsn_mapping[$i].path_template: must be a path starting with /";
+        }
+
+        if (isset($mapping['forward_scheme']) && !in_array(strtolower((string) $mapping['forward_scheme']), ['http', 'https'], true)) {
+            $problems[] = "dsn_mapping[$i].forward_scheme: must be http or https";
+        }
+
+        if (isset($mapping['forward_host']) && (!is_string($mapping['forward_host']) || !preg_match('/^[A-Za-z0-9.-]+(:\d{1,5})?$|^\[[0-9A-Fa-f:.]+\](:\d{1,5})?$/', $mapping['forward_host']))) {
+            $problems[] = "dsn_mapping[$i].forward_host: must be a host name, optionally with a :port";
+        }
+
+        if (isset($mapping['rewrite_payload_dsn']) && !is_bool($mapping['rewrite_payload_dsn'])) {
+            $problems[] = "dsn_mapping[$i].rewrite_payload_dsn: must be true or false";
+        }
+    }
+
+    return $problems;
+}
+
+function validateProfiles($profiles)
+{
+    if (!is_array($profiles) || !$profiles || array_is_list($profiles)) {
+        return ['profiles must map profile names to profiles'];
+    }
+
+    $problems = [];
+    $ports = [];
+
+    foreach ($profiles as $name => $profile) {
+        $port = $profile['port'] ?? null;
+
+        if (!is_null($port) && (!is_int($port) || $port < 1 || $port > 65535)) {
+            $problems[] = "profiles.$name.port: must be a port number";
+        } elseif (isset($ports[$port])) {
+            $problems[] = "profiles.$name.port: already used by profiles.{$ports[$port]}";
+        } elseif (!is_null($port)) {
+            $ports[$port] = $name;
+        }
+
+        foreach (validateConfig(is_array($profile) ? array_diff_key($profile, ['profiles' => true]) : null) as $problem) {
+            $problems[] = "profiles.$name.$problem";
+        }
+    }
+
+    return $problems;
+}
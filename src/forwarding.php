@@ -0,0 +1,1416 @@
+<?php
+
+// Mapping lookup, payload rewriting and the forward itself, for the Forwarder and public/index.php
+
+use GuzzleHttp\Client;
+use GuzzleHttp\Exception\ConnectException;
+use GuzzleHttp\Exception\RequestException;
+use GuzzleHttp\Exception\TransferException;
+use GuzzleHttp\Psr7\AppendStream;
+use GuzzleHttp\Psr7\LimitStream;
+use GuzzleHttp\Psr7\Uri;
+use GuzzleHttp\Psr7\Utils;
+use Psr\Http\Message\ResponseInterface as Response;
+use Psr\Http\Message\ServerRequestInterface as Request;
+use Psr\Http\Message\StreamInterface;
+
+const HOP_BY_HOP_HEADERS = [
+    'connection', 'keep-alive', 'proxy-authenticate', 'proxy-authorization', 'te', 'trailer', 'transfer-encoding', 'upgrade',
+];
+
+/**
+ * Removes the headers that only apply to a single connection, including any the
+ * Connection header itself lists, as a reverse proxy must before forwarding.
+ */
+function stripHopByHopHeaders($headers)
+{
+    $drop = HOP_BY_HOP_HEADERS;
+
+    foreach ($headers as $name => $values) {
+        if (strtolower($name) === 'connection') {
+            foreach ((array) $values as $value) {
+                foreach (explode(',', $value) as $token) {
+                    $drop[] = strtolower(trim($token));
+                }
+            }
+        }
+    }
+
+    foreach (array_keys($headers) as $name) {
+        if (in_array(strtolower($name), $drop, true)) {
+            unset($headers[$name]);
+        }
+    }
+
+    return $headers;
+}
+
+function withoutHeader($headers, $name)
+{
+    foreach (array_keys($headers) as $header) {
+        if (strcasecmp($header, $name) === 0) {
+            unset($headers[$header]);
+        }
+    }
+
+    return $headers;
+}
+
+/**
+ * Parses an X-Sentry-Auth value into lower-cased keys. Tolerates the optional "Sentry"
+ * auth scheme, stray whitespace, pairs separated by `;` as well as `,` (and stray leading
+ * or trailing separators), and quoted values, which may hold spaces and separators.
+ */
+function parseAuthHeader($headerValue)
+{
+    $headerValue = preg_replace('/^\s*sentry\s+/i', '', $headerValue);
+    preg_match_all('/([a-z_]+)\s*=\s*(?:"([^"]*)"|([^,;]*))/i', $headerValue, $matches, PREG_SET_ORDER);
+
+    $values = [];
+
+    foreach ($matches as $match) {
+        $values[strtolower($match[1])] = array_key_exists(3, $match) ? trim($match[3]) : $match[2];
+    }
+
+    return $values;
+}
+
+function getOldKey($headerValue)
+{
+    $key = parseAuthHeader($headerValue)['sentry_key'] ?? null;
+
+    return $key === '' ? null : $key;
+}
+
+/**
+ * Rebuilds an X-Sentry-Auth value with the new DSN's credentials. The secret key of legacy
+ * `public:secret@` DSNs is only sent if the new DSN has one; every other component is
+ * kept in its original order.
+ */
+function rewriteAuthHeader($value, $mapping)
+{
+    $values = parseAuthHeader($value);
+    $values['sentry_key'] = $mapping['new_uri']['user'];
+
+    if (isset($mapping['new_uri']['pass'])) {
+        $values['sentry_secret'] = $mapping['new_uri']['pass'];
+    } else {
+        unset($values['sentry_secret']);
+    }
+
+    $pairs = [];
+
+    foreach ($values as $name => $component) {
+        $pairs[] = $name . '=' . (preg_match('/[\s,;"]/', $component) ? '"' . str_replace('"', '', $component) . '"' : $component);
+    }
+
+    return 'Sentry ' . implode(', ', $pairs);
+}
+
+function getProjectId($path)
+{
+    return preg_match('#^/?api/(\d+)/#', $path, $matches) ? $matches[1] : null;
+}
+
+/**
+ * The ingest endpoint an event path targets. Paths outside /api/{project}/ are envelopes,
+ * as the forwarder has always treated them (e.g. a tunnel URL); any other endpoint under
+ * it, such as otlp/ or unreal/, is unsupported and gives null rather than being re-routed.
+ */
+function getEndpoint($path)
+{
+    if (!preg_match('#^/?api/[^/]+/(.*)$#', $path, $matches)) {
+        return 'envelope';
+    }
+
+    return preg_match('#^(envelope|store|minidump|security)/?$#', $matches[1], $endpoint) ? $endpoint[1] : null;
+}
+
+/**
+ * A mapping's `new` is either one DSN or a list of DSNs that each receive a copy of the
+ * event; `new_uri`/`new_dsn` always refer to the first of them.
+ */
+function buildMapping($old, $dsnMapping)
+{
+    $mode = mappingMode($dsnMapping);
+    $targets = [];
+
+    // A new DSN equal to the old one makes the forwarder a transparent proxy for it, unless
+    // the mapping still asks for its items to be filtered or rewritten
+    $touchesItems = ($dsnMapping['rewrite_payload_dsn'] ?? false) || isset($dsnMapping['item_types']);
+
+    foreach ($mode === 'drop' ? [] : (array) $dsnMapping['new'] as $new) {
+        $targets[] = ['new_uri' => parse_url($new), 'new_dsn' => $new, 'passthrough' => $new === $old && !$touchesItems];
+    }
+
+    return [
+        'old_uri' => parse_url($old),
+        'new_uri' => $targets[0]['new_uri'] ?? null,
+        'old_dsn' => $old,
+        'new_dsn' => $targets[0]['new_dsn'] ?? null,
+        'targets' => $targets,
+        'passthrough' => $targets && !in_array(false, array_column($targets, 'passthrough'), true),
+        'mode' => $mode,
+        'fanout' => $dsnMapping['fanout'] ?? 'any',
+        'rewrite_payload_dsn' => $dsnMapping['rewrite_payload_dsn'] ?? false,
+        'item_types' => $dsnMapping['item_types'] ?? null,
+        'max_decompressed_bytes' => $dsnMapping['max_decompressed_bytes'] ?? null,
+        'path_template' => $dsnMapping['path_template'] ?? null,
+        'forward_scheme' => $dsnMapping['forward_scheme'] ?? null,
+        'forward_host' => $dsnMapping['forward_host'] ?? null,
+        'rate_limit' => $dsnMapping['rate_limit'] ?? null,
+        'sample_rate' => (float) ($dsnMapping['sample_rate'] ?? 1),
+    ];
+}
+
+/**
+ * Parses every DSN once and indexes the mappings by old public key, or by old
+ * project ID for `match_by: project` entries. The first entry wins on duplicates.
+ */
+function buildMappings($dsnMappings)
+{
+    $index = ['by_key' => [], 'by_project' => [], 'default' => null];
+
+    foreach ($dsnMappings as $dsnMapping) {
+        // Disabled mappings stay in the config but their keys are treated as unknown
+        if (!($dsnMapping['enabled'] ?? true)) {
+            continue;
+        }
+
+        foreach (oldDsns($dsnMapping) as $old) {
+            $mapping = buildMapping($old, $dsnMapping);
+
+            if ($old === '*') {
+                $index['default'] ??= $mapping;
+            } elseif (($dsnMapping['match_by'] ?? 'key') === 'project') {
+                $index['by_project'][splitDsnPath($mapping['old_uri'])[1]] ??= $mapping;
+            } else {
+                $index['by_key'][$mapping['old_uri']['user']] ??= $mapping;
+            }
+        }
+    }
+
+    return $index;
+}
+
+/**
+ * Key matches always take precedence over project matches, and both over the
+ * catch-all mapping, if the config has one.
+ */
+function getMapping($oldKey, $projectId, $mappings)
+{
+    if (!is_null($oldKey) && isset($mappings['by_key'][$oldKey])) {
+        return $mappings['by_key'][$oldKey];
+    }
+
+    if (!is_null($projectId) && isset($mappings['by_project'][$projectId])) {
+        return $mappings['by_project'][$projectId];
+    }
+
+    return $mappings['default'];
+}
+
+/**
+ * zstd needs the zstd extension; without it such bodies count as opaque and are
+ * forwarded unchanged, header included.
+ */
+function detectEncoding($payload, $header)
+{
+    $encoding = strtolower(trim($header));
+    $supported = function_exists('zstd_uncompress_init') ? ['gzip', 'deflate', 'zstd'] : ['gzip', 'deflate'];
+
+    if (in_array($encoding, $supported, true)) {
+        return $encoding;
+    }
+
+    return strncmp($payload, "\x1f\x8b", 2) === 0 ? 'gzip' : 'identity';
+}
+
+/**
+ * A body that cannot be forwarded. The reason labels the failure in logs and metrics,
+ * so bad payloads can be told apart from upstream trouble.
+ */
+class PayloadException extends RuntimeException
+{
+    public $reason;
+    public $status;
+
+    public function __construct($reason, $message, $status = 400)
+    {
+        parent::__construct($message);
+
+        $this->reason = $reason;
+        $this->status = $status;
+    }
+}
+
+class PayloadTooLargeException extends PayloadException
+{
+    public function __construct($message)
+    {
+        parent::__construct('size_limit', $message, 413);
+    }
+}
+
+/**
+ * An envelope all of whose items a mapping's `item_types` filter removed; it is
+ * acknowledged without being forwarded.
+ */
+class EnvelopeFilteredException extends RuntimeException
+{
+}
+
+/**
+ * Inflates in small steps, so a decompression bomb fails as soon as it grows past
+ * $maxSize instead of after it has been expanded in memory.
+ */
+function inflateLimited($payload, $window, $maxSize)
+{
+    $context = inflate_init($window);
+    $decoded = '';
+
+    for ($offset = 0; $offset <= strlen($payload); $offset += 4096) {
+        $last = $offset + 4096 > strlen($payload);
+        $chunk = @inflate_add($context, substr($payload, $offset, 4096), $last ? ZLIB_FINISH : ZLIB_SYNC_FLUSH);
+
+        if ($chunk === false) {
+            return false;
+        }
+
+        $decoded .= $chunk;
+
+        if (strlen($decoded) > $maxSize) {
+            throw new PayloadTooLargeException('Decompressed payload exceeds ' . $maxSize . ' bytes');
+        }
+    }
+
+    // A truncated stream inflates without complaint as far as it goes; only a stream that
+    // reached its end has had its trailer, and with it the gzip CRC and length, checked
+    if (inflate_get_status($context) !== ZLIB_STREAM_END) {
+        return false;
+    }
+
+    return $decoded;
+}
+
+/**
+ * The zstd counterpart of inflateLimited().
+ */
+function zstdUncompressLimited($payload, $maxSize)
+{
+    $context = zstd_uncompress_init();
+    $decoded = '';
+
+    for ($offset = 0; $offset < strlen($payload); $offset += 4096) {
+        $chunk = @zstd_uncompress_add($context, substr($payload, $offset, 4096));
+
+        if ($chunk === false) {
+            return false;
+        }
+
+        $decoded .= $chunk;
+
+        if (strlen($decoded) > $maxSize) {
+            throw new PayloadTooLargeException('Decompressed payload exceeds ' . $maxSize . ' bytes');
+        }
+    }
+
+    return $decoded;
+}
+
+function decodePayload($payload, $encoding, $maxSize)
+{
+    switch ($encoding) {
+        case 'gzip':
+            $decoded = inflateLimited($payload, ZLIB_ENCODING_GZIP, $maxSize);
+            break;
+        case 'deflate':
+            // HTTP "deflate" is zlib-wrapped, but some clients send raw deflate
+            $decoded = inflateLimited($payload, ZLIB_ENCODING_DEFLATE, $maxSize);
+
+            if ($decoded === false) {
+                $decoded = inflateLimited($payload, ZLIB_ENCODING_RAW, $maxSize);
+            }
+            break;
+        case 'zstd':
+            $decoded = zstdUncompressLimited($payload, $maxSize);
+            break;
+        default:
+            return $payload;
+    }
+
+    if ($decoded === false) {
+        throw new PayloadException('decompress', 'Unable to decompress ' . $encoding . ' payload: truncated or corrupt');
+    }
+
+    return $decoded;
+}
+
+/**
+ * Recompresses at GZIP_LEVEL (1-9). The default of 1 favours throughput: rewriting large
+ * attachment envelopes at higher levels costs noticeably more CPU for a few percent less
+ * upstream bandwidth.
+ */
+function encodePayload($payload, $encoding)
+{
+    $level = max(1, min(9, (int) env('GZIP_LEVEL', 1)));
+
+    switch ($encoding) {
+        case 'gzip':
+            $encoded = gzencode($payload, $level);
+            break;
+        case 'deflate':
+            $encoded = gzcompress($payload, $level);
+            break;
+        case 'zstd':
+            // zstd's own levels run to 22; its default is already fast
+            $encoded = zstd_compress($payload);
+            break;
+        default:
+            return $payload;
+    }
+
+    if ($encoded === false) {
+        throw new PayloadException('recompress', 'Unable to recompress ' . $encoding . ' payload', 500);
+    }
+
+    return $encoded;
+}
+
+function envelopeNeedsRewrite($header, $mapping)
+{
+    return (isset($header->dsn) && $header->dsn !== $mapping['new_dsn'])
+        || (isset($header->trace->public_key) && $header->trace->public_key !== $mapping['new_uri']['user']);
+}
+
+function rewriteEnvelopeHeader($header, $mapping)
+{
+    if (isset($header->dsn)) {
+        $header->dsn = $mapping['new_dsn'];
+    }
+
+    if (isset($header->trace->public_key)) {
+        $header->trace->public_key = $mapping['new_uri']['user'];
+    }
+
+    return $header;
+}
+
+/**
+ * Returns the rewritten envelope header line, or null when it needs no rewrite or the
+ * line is not an envelope header at all (e.g. a raw upload).
+ */
+function rewriteHeaderLine($line, $mapping)
+{
+    $header = json_decode($line);
+
+    // Something that starts like an envelope header but doesn't parse is a broken envelope
+    if (is_null($header) && ($mapping['envelope'] ?? false) && str_starts_with(ltrim($line), '{')) {
+        throw new PayloadException('envelope_parse', 'Invalid envelope header: ' . json_last_error_msg());
+    }
+
+    if (!is_object($header)) {
+        return null;
+    }
+
+    // Store bodies are whole events, user data and all, so only envelope headers are dumped
+    if (($mapping['envelope'] ?? false) && filter_var(env('DEBUG_DUMP_PAYLOAD', 'false'), FILTER_VALIDATE_BOOLEAN)) {
+        logEvent('debug', 'Envelope header', ['old_dsn' => dsnLabel($mapping['old_uri']), 'header' => redactEnvelopeHeader($header)]);
+    }
+
+    // SDKs may leave the dsn out and rely on the auth header alone; state the new one
+    // outright so the header can't contradict the rewritten credentials
+    if (!isset($header->dsn) && ($mapping['inject_dsn'] ?? false)) {
+        $header->dsn = $mapping['new_dsn'];
+        incrementCounter('sentry_forwarder_envelope_dsn_injected_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+    } elseif (!envelopeNeedsRewrite($header, $mapping)) {
+        return null;
+    } elseif (isset($header->dsn) && $header->dsn !== $mapping['new_dsn'] && ($mapping['envelope'] ?? false)) {
+        incrementCounter('sentry_forwarder_envelope_dsn_mismatch_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+    }
+
+    return json_encode(rewriteEnvelopeHeader($header, $mapping), JSON_UNESCAPED_SLASHES | JSON_UNESCAPED_UNICODE);
+}
+
+/**
+ * A copy of an envelope header that is safe to log: DSNs lose their keys, and the public
+ * key and user details in the trace context are masked. Item payloads are never logged.
+ */
+function redactEnvelopeHeader($header)
+{
+    $copy = json_decode(json_encode($header));
+
+    if (isset($copy->dsn) && is_string($copy->dsn)) {
+        $copy->dsn = dsnLabel(parse_url($copy->dsn) ?: []);
+    }
+
+    if (isset($copy->trace) && is_object($copy->trace)) {
+        foreach (get_object_vars($copy->trace) as $name => $value) {
+            if ($name === 'public_key' || str_starts_with($name, 'user')) {
+                $copy->trace->$name = '[redacted]';
+            }
+        }
+    }
+
+    return $copy;
+}
+
+/**
+ * Sets every `dsn` field, at any depth, to the new DSN. Returns whether anything changed.
+ */
+function replaceDsns(&$value, $newDsn)
+{
+    $changed = false;
+
+    foreach ($value as $key => &$child) {
+        if ($key === 'dsn' && is_string($child)) {
+            $changed = $changed || $child !== $newDsn;
+            $child = $newDsn;
+        } elseif (is_object($child) || is_array($child)) {
+            $changed = replaceDsns($child, $newDsn) || $changed;
+        }
+    }
+
+    return $changed;
+}
+
+/**
+ * Splits the items that follow an envelope header. An item with a `length` is exactly that
+ * many bytes, newlines and all, so binary attachments split correctly; only items without
+ * one end at the next newline. Each item keeps its raw header line and the newline, if
+ * any, that ended it, so untouched items serialize back byte for byte.
+ */
+function parseEnvelopeItems($items)
+{
+    $parsed = [];
+    $offset = 0;
+    $total = strlen($items);
+
+    while ($offset < $total) {
+        $end = strpos($items, "\n", $offset);
+        $end = $end === false ? $total : $end;
+        $headerLine = substr($items, $offset, $end - $offset);
+        $header = json_decode($headerLine);
+
+        if (!is_object($header)) {
+            throw new PayloadException('envelope_parse', 'Invalid envelope item header at byte ' . $offset);
+        }
+
+        $start = min($end + 1, $total);
+
+        if (isset($header->length)) {
+            $length = $header->length;
+
+            if (!is_int($length) || $length < 0 || $start + $length > $total) {
+                throw new PayloadException('envelope_parse', 'Envelope item length out of range at byte ' . $offset);
+            }
+        } else {
+            $next = strpos($items, "\n", $start);
+            $length = ($next === false ? $total : $next) - $start;
+        }
+
+        $parsed[] = [
+            'header' => $header,
+            'header_line' => $headerLine,
+            'payload' => substr($items, $start, $length),
+            'terminator' => substr($items, $start + $length, 1) === "\n" ? "\n" : '',
+        ];
+
+        $offset = $start + $length + 1;
+    }
+
+    return $parsed;
+}
+
+/**
+ * Replaces an item's payload, keeping a declared `length` in step with it.
+ */
+function withItemPayload($item, $payload)
+{
+    $item['payload'] = $payload;
+
+    if (isset($item['header']->length)) {
+        $item['header']->length = strlen($payload);
+        $item['header_line'] = json_encode($item['header'], JSON_UNESCAPED_SLASHES | JSON_UNESCAPED_UNICODE);
+    }
+
+    return $item;
+}
+
+function serializeEnvelopeItems($items)
+{
+    $out = '';
+
+    foreach ($items as $item) {
+        $out .= $item['header_line'] . "\n" . $item['payload'] . $item['terminator'];
+    }
+
+    return $out;
+}
+
+/**
+ * Whether an item's payload is JSON; items without a `content_type` are, unless they're attachments.
+ */
+function isJsonItem($item)
+{
+    $contentType = strtolower($item['header']->content_type ?? '');
+
+    return $contentType === '' ? ($item['header']->type ?? null) !== 'attachment' : str_starts_with($contentType, 'application/json');
+}
+
+/**
+ * Drops the items whose type a mapping's `item_types` doesn't list, then, with
+ * `rewrite_payload_dsn`, rewrites the `dsn` fields inside event and transaction items.
+ * Returns null when no item changed.
+ */
+function rewriteItems($items, $mapping)
+{
+    $parsed = parseEnvelopeItems($items);
+    $changed = false;
+
+    if (!is_null($mapping['item_types'] ?? null)) {
+        $kept = array_values(array_filter($parsed, function ($item) use ($mapping) {
+            return in_array($item['header']->type ?? null, $mapping['item_types'], true);
+        }));
+
+        if ($parsed && !$kept) {
+            throw new EnvelopeFilteredException('No envelope items of the allowed types');
+        }
+
+        $changed = count($kept) !== count($parsed);
+        $parsed = $kept;
+    }
+
+    foreach (($mapping['rewrite_payload_dsn'] ?? false) ? $parsed : [] as $i => $item) {
+        if (!in_array($item['header']->type ?? null, ['event', 'transaction'], true) || !isJsonItem($item)) {
+            continue;
+        }
+
+        $event = json_decode($item['payload']);
+
+        if (is_object($event) && replaceDsns($event, $mapping['new_dsn'])) {
+            $parsed[$i] = withItemPayload($item, json_encode($event, JSON_UNESCAPED_SLASHES | JSON_UNESCAPED_UNICODE));
+            $changed = true;
+        }
+    }
+
+    return $changed ? serializeEnvelopeItems($parsed) : null;
+}
+
+/**
+ * Returns the body to forward, the size of the decoded payload and its event ID. The DSN normally only
+ * lives in the envelope header, so unless the mapping asks to rewrite item payloads too,
+ * only the first line is parsed and the items are appended as-is.
+ */
+function convertPayload($original, $mapping, $encoding, $maxSize)
+{
+    $payload = decodePayload($original, $encoding, $maxSize);
+    $newline = strpos($payload, "\n");
+    $eventId = headerEventId($newline === false ? $payload : substr($payload, 0, $newline));
+    $line = rewriteHeaderLine($newline === false ? $payload : substr($payload, 0, $newline), $mapping);
+    $items = $newline === false ? null : substr($payload, $newline + 1);
+
+    if (!is_null($items) && (($mapping['rewrite_payload_dsn'] ?? false) || !is_null($mapping['item_types'] ?? null))) {
+        $rewritten = rewriteItems($items, $mapping);
+
+        if (!is_null($rewritten)) {
+            $line = $line ?? substr($payload, 0, $newline);
+            $items = $rewritten;
+        }
+    }
+
+    if (!is_null($mapping['rewrite_hook'] ?? null)) {
+        $hooked = applyRewriteHook($mapping['rewrite_hook'], $line ?? ($newline === false ? $payload : substr($payload, 0, $newline)), $items);
+
+        if (!is_null($hooked)) {
+            list($line, $items) = $hooked;
+        }
+    }
+
+    // Raw uploads and envelopes that already point at the new DSN go out byte-identical
+    if (is_null($line)) {
+        return [$original, strlen($payload), $eventId];
+    }
+
+    $payload = is_null($items) ? $line : $line . "\n" . $items;
+
+    return [encodePayload($payload, $encoding), strlen($payload), $eventId];
+}
+
+/**
+ * Hands an envelope to a Forwarder's rewrite hook and serializes what it returns. Items
+ * are given as their `header` object and `payload` string, and get their declared
+ * `length` updated afterwards. Returns null for bodies that aren't envelopes.
+ */
+function applyRewriteHook(callable $hook, $line, $items)
+{
+    $header = json_decode($line);
+
+    if (!is_object($header)) {
+        return null;
+    }
+
+    $parsed = array_map(function ($item) {
+        return ['header' => $item['header'], 'payload' => $item['payload']];
+    }, parseEnvelopeItems($items ?? ''));
+
+    list($header, $parsed) = $hook($header, $parsed);
+    $lines = [];
+
+    foreach ($parsed as $item) {
+        if (isset($item['header']->length)) {
+            $item['header']->length = strlen($item['payload']);
+        }
+
+        $lines[] = json_encode($item['header'], JSON_UNESCAPED_SLASHES | JSON_UNESCAPED_UNICODE) . "\n" . $item['payload'];
+    }
+
+    return [json_encode($header, JSON_UNESCAPED_SLASHES | JSON_UNESCAPED_UNICODE), $lines ? implode("\n", $lines) : null];
+}
+
+/**
+ * Rewrites the header line of an uncompressed envelope and streams the items after it
+ * straight from the request body, so large attachments are never copied in memory.
+ * Returns the stream to send, its length and the envelope's event ID.
+ */
+function streamPayload(StreamInterface $stream, $size, $mapping, $maxHeaderSize)
+{
+    $stream->rewind();
+    $buffer = '';
+
+    while (!$stream->eof() && strpos($buffer, "\n") === false) {
+        $buffer .= $stream->read(8192);
+
+        if (strlen($buffer) > $maxHeaderSize) {
+            throw new PayloadTooLargeException('Envelope header exceeds ' . $maxHeaderSize . ' bytes');
+        }
+    }
+
+    $offset = strpos($buffer, "\n");
+    $offset = $offset === false ? strlen($buffer) : $offset;
+
+    $line = substr($buffer, 0, $offset);
+    $eventId = headerEventId($line);
+    $line = rewriteHeaderLine($line, $mapping) ?? $line;
+
+    $body = new AppendStream([Utils::streamFor($line), new LimitStream($stream, -1, $offset)]);
+
+    return [$body, strlen($line) + $size - $offset, $eventId];
+}
+
+/**
+ * Lists each loaded mapping with its DSNs reduced to dsnLabel(), so the summary can be
+ * shared without leaking keys. $withStatus adds each mapping's forward status.
+ */
+function configSummary($mappings, $withStatus = false)
+{
+    $all = array_merge(array_values($mappings['by_key']), array_values($mappings['by_project']));
+
+    if (!is_null($mappings['default'])) {
+        $all[] = $mappings['default'];
+    }
+
+    return array_map(function ($mapping) use ($withStatus) {
+        return mappingSummary($mapping, $withStatus);
+    }, $all);
+}
+
+function mappingSummary($mapping, $withStatus = false)
+{
+    $summary = [
+        'old' => dsnLabel($mapping['old_uri']),
+        'new' => array_map(function ($target) {
+            return dsnLabel($target['new_uri']);
+        }, $mapping['targets']),
+        'mode' => $mapping['mode'],
+    ];
+
+    if ($withStatus) {
+        $summary['status'] = (object) forwardStatus($mapping);
+    }
+
+    return $summary;
+}
+
+/**
+ * Which of getMapping()'s lookups resolves a key and project: "key", "project",
+ * "default" for the catch-all, or null when nothing matches.
+ */
+function mappingMatch($oldKey, $projectId, $mappings)
+{
+    if (!is_null($oldKey) && isset($mappings['by_key'][$oldKey])) {
+        return 'key';
+    }
+
+    if (!is_null($projectId) && isset($mappings['by_project'][$projectId])) {
+        return 'project';
+    }
+
+    return is_null($mappings['default']) ? null : 'default';
+}
+
+/**
+ * Whether an Accept-Encoding value allows gzip, honouring q=0 and the * wildcard.
+ */
+function acceptsGzip($header)
+{
+    $accepted = false;
+
+    foreach (explode(',', strtolower($header)) as $part) {
+        $params = array_map('trim', explode(';', $part));
+        $coding = array_shift($params);
+        $quality = 1.0;
+
+        foreach ($params as $param) {
+            if (str_starts_with($param, 'q=')) {
+                $quality = (float) substr($param, 2);
+            }
+        }
+
+        // An explicit gzip entry wins over the wildcard either way
+        if ($coding === 'gzip') {
+            return $quality > 0;
+        }
+
+        if ($coding === '*') {
+            $accepted = $quality > 0;
+        }
+    }
+
+    return $accepted;
+}
+
+/**
+ * What build is running, from the FORWARDER_* variables the Docker build sets.
+ */
+function buildInfo()
+{
+    return [
+        'version' => env('FORWARDER_VERSION', 'dev'),
+        'commit' => env('FORWARDER_COMMIT'),
+        'build_date' => env('FORWARDER_BUILD_DATE'),
+        'php_version' => PHP_VERSION,
+    ];
+}
+
+/**
+ * Whether the request carries $token as its bearer token.
+ */
+function hasBearerToken(Request $request, $token)
+{
+    return hash_equals('Bearer ' . $token, $request->getHeaderLine('Authorization'));
+}
+
+/**
+ * PHP has already parsed multipart bodies into fields and files, with bracketed names
+ * like sentry[release] turned into nested arrays; this flattens them back into parts.
+ */
+function multipartParts($fields, $files, $prefix = '')
+{
+    $parts = [];
+
+    foreach ($fields as $name => $value) {
+        $key = $prefix === '' ? $name : $prefix . '[' . $name . ']';
+        $parts = array_merge($parts, is_array($value) ? multipartParts($value, [], $key) : [['name' => $key, 'contents' => (string) $value]]);
+    }
+
+    foreach ($files as $name => $file) {
+        $key = $prefix === '' ? $name : $prefix . '[' . $name . ']';
+
+        if (is_array($file)) {
+            $parts = array_merge($parts, multipartParts([], $file, $key));
+            continue;
+        }
+
+        // PHP drops a file it couldn't take, and getStream() would then throw. Files over
+        // upload_max_filesize are too large, anything else is a broken upload
+        if ($file->getError() !== UPLOAD_ERR_OK) {
+            $tooLarge = in_array($file->getError(), [UPLOAD_ERR_INI_SIZE, UPLOAD_ERR_FORM_SIZE], true);
+
+            throw new PayloadException($tooLarge ? 'size_limit' : 'upload', 'Upload ' . $key . ' failed with PHP upload error ' . $file->getError(), $tooLarge ? 413 : 400);
+        }
+
+        // Rewound because the same upload may already have been sent to another target
+        $stream = $file->getStream();
+        $stream->rewind();
+
+        $parts[] = [
+            'name' => $key,
+            'contents' => $stream,
+            'filename' => $file->getClientFilename(),
+            'headers' => ['Content-Type' => $file->getClientMediaType() ?: 'application/octet-stream'],
+        ];
+    }
+
+    return $parts;
+}
+
+/**
+ * Returns the request's Origin when CORS_ALLOWED_ORIGINS allows it ("*" allows any).
+ */
+function corsOrigin(Request $request)
+{
+    $origin = $request->getHeaderLine('Origin');
+    $allowed = envList('CORS_ALLOWED_ORIGINS');
+
+    if ($origin === '' || !(in_array('*', $allowed, true) || in_array($origin, $allowed, true))) {
+        return null;
+    }
+
+    return $origin;
+}
+
+function withCorsHeaders(Response $response, $origin)
+{
+    if (is_null($origin)) {
+        return $response;
+    }
+
+    return $response
+        ->withHeader('Access-Control-Allow-Origin', $origin)
+        ->withAddedHeader('Vary', 'Origin')
+        // SDKs back off based on these, so browsers must let them read them
+        ->withHeader('Access-Control-Expose-Headers', 'Retry-After, X-Sentry-Rate-Limits, X-Sentry-Error');
+}
+
+function envList($name)
+{
+    return array_values(array_filter(array_map('trim', explode(',', (string) env($name, '')))));
+}
+
+/**
+ * Works for IPv4 and IPv6; a bare address without a prefix length matches only itself,
+ * and one with an invalid prefix length matches nothing.
+ */
+function ipInCidr($ip, $cidr)
+{
+    list($subnet, $bits) = array_pad(explode('/', $cidr, 2), 2, null);
+    $ipBytes = @inet_pton($ip);
+    $subnetBytes = @inet_pton($subnet);
+
+    if ($ipBytes === false || $subnetBytes === false || strlen($ipBytes) !== strlen($subnetBytes)) {
+        return false;
+    }
+
+    // A typo such as "10.0.0.0/" must not widen to /0 and match everyone
+    if (!is_null($bits) && (!ctype_digit($bits) || (int) $bits > strlen($subnetBytes) * 8)) {
+        logEvent('warn', 'Ignoring invalid CIDR', ['cidr' => $cidr]);
+
+        return false;
+    }
+
+    $bits = is_null($bits) ? strlen($ipBytes) * 8 : (int) $bits;
+    $bytes = intdiv($bits, 8);
+    $remainder = $bits % 8;
+
+    if (strncmp($ipBytes, $subnetBytes, $bytes) !== 0) {
+        return false;
+    }
+
+    if ($remainder === 0) {
+        return true;
+    }
+
+    $mask = chr((0xff << (8 - $remainder)) & 0xff);
+
+    return ($ipBytes[$bytes] & $mask) === ($subnetBytes[$bytes] & $mask);
+}
+
+function ipInList($ip, $cidrs)
+{
+    foreach ($cidrs as $cidr) {
+        if (ipInCidr($ip, $cidr)) {
+            return true;
+        }
+    }
+
+    return false;
+}
+
+/**
+ * Reduces an address as proxies write it, e.g. "203.0.113.7:4711" or "[2001:db8::1]:443",
+ * to the bare IP. Anything that isn't an IP is returned trimmed but otherwise as-is.
+ */
+function normalizeIp($address)
+{
+    $address = trim($address);
+
+    if (preg_match('/^\[([0-9a-f:.]+)\](?::\d+)?$/i', $address, $matches)) {
+        return $matches[1];
+    }
+
+    // One colon means IPv4 with a port; bare IPv6 has several
+    if (substr_count($address, ':') === 1) {
+        $address = explode(':', $address)[0];
+    }
+
+    return $address;
+}
+
+/**
+ * X-Forwarded-For is only believed when the connection comes from one of
+ * TRUSTED_PROXIES; the client is then the nearest hop that is not itself trusted.
+ */
+function clientIp(Request $request)
+{
+    $ip = normalizeIp($request->getServerParams()['REMOTE_ADDR'] ?? '');
+    $trusted = envList('TRUSTED_PROXIES');
+
+    if (!ipInList($ip, $trusted) || !$request->hasHeader('X-Forwarded-For')) {
+        return $ip;
+    }
+
+    $hops = array_map('normalizeIp', explode(',', $request->getHeaderLine('X-Forwarded-For')));
+
+    foreach (array_reverse($hops) as $hop) {
+        if (!ipInList($hop, $trusted)) {
+            return $hop;
+        }
+    }
+
+    return $hops[0];
+}
+
+/**
+ * Keeps an event with probability $rate. The decision is derived from the event_id when
+ * there is one, so an SDK retrying the same event always gets the same answer.
+ */
+function sampleEvent($eventId, $rate)
+{
+    $roll = is_null($eventId) ? mt_rand() / mt_getrandmax() : hexdec(substr(md5($eventId), 0, 8)) / 0xffffffff;
+
+    return $roll < $rate;
+}
+
+/**
+ * A token bucket shared by all PHP workers, kept in a flock'd file per old DSN. Takes
+ * one token and returns 0, or the seconds until one is available when the bucket is empty.
+ */
+function takeRateToken($oldDsn, $rate, $burst)
+{
+    // Like metrics, a broken limiter never blocks a forward
+    return updateStateFile(sys_get_temp_dir() . '/sentry-forwarder-ratelimit-' . md5($oldDsn) . '.json', function ($bucket) use ($rate, $burst) {
+        $now = microtime(true);
+        $bucket = $bucket ?: ['tokens' => $burst, 'time' => $now];
+        $tokens = min($burst, $bucket['tokens'] + ($now - $bucket['time']) * $rate);
+        $wait = $tokens >= 1 ? 0 : (1 - $tokens) / $rate;
+
+        return [['tokens' => $wait > 0 ? $tokens : $tokens - 1, 'time' => $now], $wait];
+    }, 0);
+}
+
+/**
+ * Runs $update on the circuit breaker state of a new DSN, kept like the rate limit buckets
+ * in a flock'd file, and returns what it returns.
+ */
+function updateBreaker($newDsn, callable $update)
+{
+    return updateStateFile(sys_get_temp_dir() . '/sentry-forwarder-breaker-' . md5($newDsn) . '.json', function ($state) use ($update) {
+        return $update($state ?: ['failures' => 0, 'opened_at' => null, 'probe_at' => null]);
+    });
+}
+
+/**
+ * With BREAKER_THRESHOLD set, that many failed forwards in a row to a new DSN open its
+ * breaker: forwards are skipped for BREAKER_COOLDOWN seconds, then a single probe is let
+ * through, and its outcome closes the breaker or opens it for another cooldown.
+ */
+function breakerAllows($newDsn)
+{
+    if ((int) env('BREAKER_THRESHOLD', 0) <= 0) {
+        return true;
+    }
+
+    $cooldown = (int) env('BREAKER_COOLDOWN', 30);
+
+    return updateBreaker($newDsn, function ($state) use ($cooldown) {
+        $now = time();
+
+        if (is_null($state['opened_at'])) {
+            return [$state, true];
+        }
+
+        // One probe at a time; one that never reported back is given up on after a cooldown
+        if ($now - $state['opened_at'] < $cooldown || (!is_null($state['probe_at']) && $now - $state['probe_at'] < $cooldown)) {
+            return [$state, false];
+        }
+
+        $state['probe_at'] = $now;
+
+        return [$state, true];
+    }) ?? true;
+}
+
+function recordBreakerResult($newDsn, $failed)
+{
+    $threshold = (int) env('BREAKER_THRESHOLD', 0);
+
+    if ($threshold <= 0) {
+        return;
+    }
+
+    $open = updateBreaker($newDsn, function ($state) use ($threshold, $failed) {
+        if (!$failed) {
+            return [['failures' => 0, 'opened_at' => null, 'probe_at' => null], false];
+        }
+
+        $state['failures']++;
+
+        if ($state['failures'] >= $threshold || !is_null($state['probe_at'])) {
+            $state['opened_at'] = time();
+            $state['probe_at'] = null;
+        }
+
+        return [$state, !is_null($state['opened_at'])];
+    });
+
+    if (!is_null($open)) {
+        setGauge('sentry_forwarder_breaker_open', ['new_dsn' => dsnLabel(parse_url($newDsn))], $open ? 1 : 0);
+    }
+}
+
+/**
+ * Bounds in-flight forwards across all PHP workers with one lock file per slot.
+ * Returns the held lock, or null when no slot frees up within $timeout seconds.
+ */
+function acquireForwardSlot($slots, $timeout)
+{
+    $deadline = microtime(true) + $timeout;
+
+    do {
+        for ($i = 0; $i < $slots; $i++) {
+            $handle = @fopen(sys_get_temp_dir() . '/sentry-forwarder-slot-' . $i . '.lock', 'c');
+
+            if ($handle !== false && flock($handle, LOCK_EX | LOCK_NB)) {
+                return $handle;
+            }
+
+            if ($handle !== false) {
+                fclose($handle);
+            }
+        }
+
+        usleep(50000);
+    } while (microtime(true) < $deadline);
+
+    return null;
+}
+
+function releaseForwardSlot($handle)
+{
+    if (!is_null($handle)) {
+        flock($handle, LOCK_UN);
+        fclose($handle);
+    }
+}
+
+function readBody($stream, $maxSize)
+{
+    $body = '';
+
+    while (!$stream->eof()) {
+        $body .= $stream->read(65536);
+
+        if (strlen($body) > $maxSize) {
+            throw new PayloadTooLargeException('Request body exceeds ' . $maxSize . ' bytes');
+        }
+    }
+
+    return $body;
+}
+
+/**
+ * Answers the way Sentry does when it accepts an event: 200 with the event ID, or an
+ * empty object when the ID is not known.
+ */
+function sentryAck($eventId)
+{
+    return is_null($eventId) ? '{}' : json_encode(['id' => $eventId]);
+}
+
+function successResponse(Response $response, $eventId)
+{
+    $response->getBody()->write(sentryAck($eventId));
+    return $response->withStatus(200)->withHeader('Content-Type', 'application/json');
+}
+
+/**
+ * Best-effort read of the event_id from the envelope header, for synthesized responses.
+ */
+function envelopeEventId(Request $request, $encoding, $maxSize)
+{
+    if (isMultipart($request)) {
+        return null;
+    }
+
+    try {
+        $stream = $request->getBody();
+        $stream->rewind();
+        $payload = decodePayload(readBody($stream, $maxSize), $encoding, $maxSize);
+        $line = strtok($payload, "\n");
+    } catch (RuntimeException $e) {
+        return null;
+    } finally {
+        $request->getBody()->rewind();
+    }
+
+    return headerEventId($line);
+}
+
+/**
+ * The event_id of an envelope header line, or null for envelopes without one and
+ * anything that isn't an envelope.
+ */
+function headerEventId($line)
+{
+    $header = json_decode((string) $line);
+
+    return is_object($header) && isset($header->event_id) && is_string($header->event_id) ? $header->event_id : null;
+}
+
+function errorResponse(Response $response, $status, $message)
+{
+    $response->getBody()->write(json_encode(['error' => $message]));
+    return $response->withStatus($status)->withHeader('Content-Type', 'application/json');
+}
+
+/**
+ * Builds {prefix}/api/{project}/{endpoint}/ on the new DSN's origin, or a mapping's
+ * `path_template` with its {project} and {endpoint} filled in. Doubled slashes are
+ * collapsed, and Uri escapes anything a path can't hold as-is.
+ */
+function upstreamUrl($uri, $endpoint, $template = null)
+{
+    list($prefix, $projectId) = splitDsnPath($uri);
+    $path = is_null($template)
+        ? $prefix . '/api/' . $projectId . '/' . $endpoint . '/'
+        : strtr($template, ['{project}' => $projectId, '{endpoint}' => $endpoint]);
+    $path = preg_replace('#/{2,}#', '/', $path);
+
+    return (string) (new Uri())
+        ->withScheme($uri['scheme'])
+        ->withHost($uri['host'])
+        ->withPort($uri['port'] ?? null)
+        ->withPath($path);
+}
+
+/**
+ * The new DSN as it is reached on the network. `forward_scheme` and `forward_host` (a host,
+ * optionally with a port) point the call elsewhere, e.g. at a local relay over plain HTTP,
+ * while the DSN itself, and everything derived from it in the forwarded event, stays as is.
+ */
+function forwardUri($mapping)
+{
+    $uri = $mapping['new_uri'];
+
+    if (!is_null($mapping['forward_scheme'] ?? null)) {
+        $uri['scheme'] = strtolower($mapping['forward_scheme']);
+    }
+
+    if (!is_null($mapping['forward_host'] ?? null)) {
+        $host = parse_url('//' . $mapping['forward_host']);
+        $uri['host'] = $host['host'];
+        unset($uri['port']);
+
+        if (isset($host['port'])) {
+            $uri['port'] = $host['port'];
+        }
+    }
+
+    return $uri;
+}
+
+function isMultipart(Request $request)
+{
+    return stripos($request->getHeaderLine('Content-Type'), 'multipart/form-data') === 0;
+}
+
+/**
+ * Builds the outbound URL and request options for one new DSN of a mapping. $data is
+ * the buffered request body, or null when the body is streamed or rebuilt from parts.
+ */
+function buildForward(Request $request, $mapping, $path, $encoding, $data, $maxSize)
+{
+    $headers = [];
+
+    foreach (stripHopByHopHeaders($request->getHeaders()) as $key => $value) {
+        // The body is rewritten and the target differs, so Guzzle works out the length
+        // and the Host (port included) from the outbound request itself
+        if (!in_array(strtolower($key), ['content-length', 'host'], true)) {
+            $headers[$key] = $value;
+        }
+    }
+
+    $oldKey = $mapping['old_uri']['user'] ?? null;
+
+    foreach (($mapping['passthrough'] ?? false) ? [] : $headers as $key => $values) {
+        if (strcasecmp($key, 'X-Sentry-Auth') === 0) {
+            $headers[$key] = array_map(function ($value) use ($mapping) {
+                return rewriteAuthHeader($value, $mapping);
+            }, $values);
+        } elseif (!is_null($oldKey) && in_array(strtolower($key), ['user-agent', 'x-sentry-client'], true)) {
+            // Sentry reads SDK analytics from these, so they go through unchanged but for a stray old key
+            $headers[$key] = str_replace($oldKey, $mapping['new_uri']['user'], $values);
+        }
+    }
+
+    $headers = withoutHeader($headers, 'X-Request-Id');
+    $headers['X-Request-Id'] = $request->getAttribute('request_id', requestId());
+
+    // Label bodies recognised by their magic bytes even if the client did not
+    if ($encoding !== 'identity' && !$request->hasHeader('Content-Encoding')) {
+        $headers['Content-Encoding'] = $encoding;
+    }
+
+    $endpoint = getEndpoint($path);
+    $url = upstreamUrl(forwardUri($mapping), $endpoint, $mapping['path_template'] ?? null);
+
+    // Only an envelope's first line is an envelope header, which may lack its dsn. A store
+    // body is one JSON event, possibly pretty-printed, so its first line may be just "{"
+    $mapping['envelope'] = $endpoint === 'envelope';
+    $mapping['inject_dsn'] = $mapping['envelope'];
+    $query = $request->getQueryParams();
+
+    // Pass on sentry_version, sentry_client etc., with the key swapped for the new one
+    if ($query) {
+        if (isset($query['sentry_key'])) {
+            $query['sentry_key'] = $mapping['new_uri']['user'];
+        }
+
+        if (isset($query['sentry_secret'], $mapping['new_uri']['pass'])) {
+            $query['sentry_secret'] = $mapping['new_uri']['pass'];
+        } else {
+            // A key-only DSN must not be sent the old project's secret
+            unset($query['sentry_secret']);
+        }
+
+        $url .= '?' . http_build_query($query);
+    }
+
+    if (isMultipart($request)) {
+        // Minidump uploads carry the key in the query string, so only the parts are rebuilt
+        $headers = withoutHeader($headers, 'Content-Type');
+        $payload = ['multipart' => multipartParts($request->getParsedBody() ?? [], $request->getUploadedFiles())];
+    } elseif ($mapping['passthrough'] ?? false) {
+        // The upstream already expects this DSN, so the body goes out exactly as received
+        $body = $data ?? $request->getBody();
+
+        if (!is_string($body)) {
+            $body->rewind();
+        }
+
+        if ($request->hasHeader('Content-Length')) {
+            $headers['Content-Length'] = $request->getHeaderLine('Content-Length');
+        }
+
+        $payload = ['body' => $body];
+        $sizes = ['forwarded_size' => is_string($body) ? strlen($body) : $body->getSize()];
+    } elseif ($endpoint === 'security') {
+        // CSP and Expect-CT reports are plain browser JSON with the key only in the query string
+        $body = $data ?? $request->getBody();
+
+        if (!is_string($body)) {
+            $body->rewind();
+        }
+
+        $payload = ['body' => $body];
+    } elseif (is_null($data)) {
+        // The declared length was checked against the limit, so the items can be streamed unbuffered
+        list($body, $length, $eventId) = streamPayload($request->getBody(), (int) $request->getHeaderLine('Content-Length'), $mapping, $maxSize);
+        $headers['Content-Length'] = $length;
+        $payload = ['body' => $body];
+        $sizes = ['event_id' => $eventId, 'decompressed_size' => $length, 'forwarded_size' => $length];
+    } else {
+        // Only envelopes have items to filter or rewrite
+        if ($endpoint !== 'envelope') {
+            $mapping['item_types'] = null;
+            $mapping['rewrite_payload_dsn'] = false;
+            $mapping['rewrite_hook'] = null;
+        }
+
+        list($body, $decodedSize, $eventId) = convertPayload($data, $mapping, $encoding, $maxSize);
+        $payload = ['body' => $body];
+        $sizes = ['event_id' => $eventId, 'decompressed_size' => $decodedSize, 'forwarded_size' => strlen($body)];
+    }
+
+    // No 'stream' option: it would swap curl for Guzzle's stream handler, which reads the
+    // body into a string and ignores connect_timeout. Curl streams the body on its own
+    return [$url, $payload + ['headers' => $headers], $sizes ?? []];
+}
+
+/**
+ * $sizes carries the event ID and payload sizes from buildForward() into the forward's
+ * log line, so a forwarded event can be looked up in the new Sentry.
+ */
+function sendForward(Client $client, $url, $options, $mapping, $sizes)
+{
+    $started = microtime(true);
+    $res = $client->request('POST', $url, $options);
+    $duration = microtime(true) - $started;
+
+    logEvent('info', 'Forwarded event', [
+        'old_dsn' => dsnLabel($mapping['old_uri']),
+        'new_dsn' => dsnLabel($mapping['new_uri']),
+        'status' => $res->getStatusCode(),
+        'duration_ms' => (int) round($duration * 1000),
+    ] + $sizes + ['event_id' => null]);
+
+    observeHistogram('sentry_forwarder_forward_duration_seconds', $duration);
+    incrementCounter('sentry_forwarder_upstream_responses_total', ['status' => $res->getStatusCode()]);
+    incrementCounter('sentry_forwarder_events_forwarded_total', ['old_dsn' => dsnLabel($mapping['old_uri'])]);
+
+    return $res;
+}
+
+/**
+ * The status for a forward that got no upstream response: 504 when it timed out, 502 for
+ * any other transport failure. Anything else is the forwarder's own fault, a 500.
+ */
+function upstreamErrorStatus($error)
+{
+    if (!$error instanceof TransferException) {
+        return 500;
+    }
+
+    $errno = $error instanceof RequestException || $error instanceof ConnectException ? ($error->getHandlerContext()['errno'] ?? null) : null;
+
+    // The stream handler reports no curl errno, only the message
+    return (defined('CURLE_OPERATION_TIMEDOUT') && $errno === CURLE_OPERATION_TIMEDOUT) || stripos($error->getMessage(), 'timed out') !== false ? 504 : 502;
+}
+
+/**
+ * With `fanout: any` (the default) the first successful upstream result is returned to
+ * the SDK, with `fanout: all` the first failure is. Otherwise the first result is used.
+ */
+function pickFanoutResult($results, $fanout)
+{
+    foreach ($results as $result) {
+        $failed = !$result instanceof Response || $result->getStatusCode() >= 400;
+
+        if ($fanout === 'all' ? $failed : !$failed) {
+            return $result;
+        }
+    }
+
+    return $results[0];
+}
+
+function relayResponse(Response $response, Response $res)
+{
+    // Respond with the status and body from the new Sentry DSN
+    $response = $response->withBody($res->getBody());
+
+    // Relay every upstream header with all its values; SDKs back off based on
+    // Retry-After and X-Sentry-Rate-Limits, which may legitimately repeat. CORS is the
+    // forwarder's own call (CORS_ALLOWED_ORIGINS), so upstream Access-Control-* never passes
+    foreach (stripHopByHopHeaders($res->getHeaders()) as $header => $values) {
+        if (strtolower($header) !== 'content-length' && stripos($header, 'access-control-') !== 0) {
+            $response = $response->withHeader($header, $values);
+        }
+    }
+
+    $response = $response->withStatus($res->getStatusCode());
+
+    // Sentry answers in JSON, but proxies in front of it may not; only label bodies that came without a type
+    return $res->hasHeader('Content-Type') ? $response : $response->withHeader('Content-Type', 'application/json');
+}
@@ -0,0 +1,218 @@
+<?php
+
+// Prometheus metrics, kept in a file shared by all PHP workers
+
+const METRICS = [
+    'sentry_forwarder_events_received_total' => ['counter', 'Events received from SDKs.'],
+    'sentry_forwarder_events_forwarded_total' => ['counter', 'Events forwarded, by old DSN.'],
+    'sentry_forwarder_unknown_dsn_total' => ['counter', 'Events rejected because no mapping matched their key.'],
+    'sentry_forwarder_events_dropped_total' => ['counter', 'Events accepted and discarded by drop mappings, by old DSN.'],
+    'sentry_forwarder_upstream_responses_total' => ['counter', 'Upstream responses, by status code.'],
+    'sentry_forwarder_forward_duration_seconds' => ['histogram', 'Round-trip time of forwards to the new DSN.'],
+    'sentry_forwarder_events_filtered_total' => ['counter', 'Envelopes acknowledged without forwarding because item_types left no items, by old DSN.'],
+    'sentry_forwarder_events_sampled_out_total' => ['counter', 'Events accepted and discarded by mapping sample rates, by old DSN.'],
+    'sentry_forwarder_rate_limited_total' => ['counter', 'Events refused by mapping rate limits, by old DSN.'],
+    'sentry_forwarder_envelope_dsn_injected_total' => ['counter', 'Envelopes forwarded with the new DSN added to a header that had none, by old DSN.'],
+    'sentry_forwarder_envelope_dsn_mismatch_total' => ['counter', 'Envelopes whose header dsn did not match the new DSN and was replaced, by old DSN.'],
+    'sentry_forwarder_payload_errors_total' => ['counter', 'Bodies that could not be forwarded, by reason.'],
+    'sentry_forwarder_breaker_open' => ['gauge', 'Whether the circuit breaker for a new DSN is open (1) or closed (0).'],
+    'sentry_forwarder_spooled_total' => ['counter', 'Failed forwards written to the spool.'],
+    'sentry_forwarder_spool_drained_total' => ['counter', 'Spooled forwards delivered after the upstream recovered.'],
+    'sentry_forwarder_spool_dropped_total' => ['counter', 'Spooled forwards discarded because the spool was full.'],
+    'sentry_forwarder_spool_depth' => ['gauge', 'Forwards currently waiting in the spool.'],
+];
+
+const DURATION_BUCKETS = [0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30];
+
+/**
+ * PHP keeps no state between requests, so state shared by all workers (metrics, rate
+ * limits, breakers, forward status) lives in JSON files guarded by flock. $update gets the
+ * decoded state, or [] for a new file, and returns [$state, $result]; $result is returned,
+ * or $failed when the file can't be opened. Failing to record state never fails a forward.
+ */
+function updateStateFile($path, callable $update, $failed = null)
+{
+    $handle = @fopen($path, 'c+');
+
+    if ($handle === false) {
+        return $failed;
+    }
+
+    flock($handle, LOCK_EX);
+
+    $state = json_decode(stream_get_contents($handle), true) ?: [];
+    list($state, $result) = $update($state);
+
+    ftruncate($handle, 0);
+    rewind($handle);
+    fwrite($handle, json_encode($state, JSON_UNESCAPED_SLASHES));
+    fflush($handle);
+    flock($handle, LOCK_UN);
+    fclose($handle);
+
+    return $result;
+}
+
+function readStateFile($path)
+{
+    $handle = @fopen($path, 'r');
+
+    if ($handle === false) {
+        return [];
+    }
+
+    flock($handle, LOCK_SH);
+    $state = json_decode(stream_get_contents($handle), true) ?: [];
+    flock($handle, LOCK_UN);
+    fclose($handle);
+
+    return $state;
+}
+
+function metricsPath()
+{
+    return env('METRICS_PATH', sys_get_temp_dir() . '/sentry-forwarder-metrics.json');
+}
+
+function updateMetrics(callable $update)
+{
+    updateStateFile(metricsPath(), function ($metrics) use ($update) {
+        return [$update($metrics), null];
+    });
+}
+
+function readMetrics()
+{
+    return readStateFile(metricsPath());
+}
+
+function metricLabels($labels)
+{
+    $pairs = [];
+
+    foreach ($labels as $name => $value) {
+        $pairs[] = $name . '="' . addcslashes((string) $value, "\\\"\n") . '"';
+    }
+
+    return implode(',', $pairs);
+}
+
+function incrementCounter($name, $labels = [], $value = 1)
+{
+    updateMetrics(function ($metrics) use ($name, $labels, $value) {
+        $key = metricLabels($labels);
+        $metrics[$name][$key] = ($metrics[$name][$key] ?? 0) + $value;
+
+        return $metrics;
+    });
+}
+
+function setGauge($name, $labels, $value)
+{
+    updateMetrics(function ($metrics) use ($name, $labels, $value) {
+        $metrics[$name][metricLabels($labels)] = $value;
+
+        return $metrics;
+    });
+}
+
+function observeHistogram($name, $value, $labels = [])
+{
+    updateMetrics(function ($metrics) use ($name, $labels, $value) {
+        $key = metricLabels($labels);
+        $metrics[$name][$key] ??= ['buckets' => array_fill(0, count(DURATION_BUCKETS), 0), 'sum' => 0, 'count' => 0];
+
+        foreach (DURATION_BUCKETS as $i => $bound) {
+            if ($value <= $bound) {
+                $metrics[$name][$key]['buckets'][$i]++;
+            }
+        }
+
+        $metrics[$name][$key]['sum'] += $value;
+        $metrics[$name][$key]['count']++;
+
+        return $metrics;
+    });
+}
+
+function renderMetrics()
+{
+    $metrics = readMetrics();
+
+    if (!is_null(env('SPOOL_DIR'))) {
+        $metrics['sentry_forwarder_spool_depth'] = ['' => count(spoolEntries())];
+    }
+    $lines = [];
+
+    foreach (METRICS as $name => list($type, $help)) {
+        $lines[] = "# HELP $name $help";
+        $lines[] = "# TYPE $name $type";
+
+        foreach ($metrics[$name] ?? [] as $labels => $value) {
+            $labels = (string) $labels;
+
+            if ($type !== 'histogram') {
+                $lines[] = $name . ($labels === '' ? '' : '{' . $labels . '}') . ' ' . $value;
+                continue;
+            }
+
+            $prefix = $labels === '' ? '' : $labels . ',';
+
+            foreach (DURATION_BUCKETS as $i => $bound) {
+                $lines[] = $name . '_bucket{' . $prefix . 'le="' . $bound . '"} ' . $value['buckets'][$i];
+            }
+
+            $lines[] = $name . '_bucket{' . $prefix . 'le="+Inf"} ' . $value['count'];
+            $lines[] = $name . '_sum' . ($labels === '' ? '' : '{' . $labels . '}') . ' ' . $value['sum'];
+            $lines[] = $name . '_count' . ($labels === '' ? '' : '{' . $labels . '}') . ' ' . $value['count'];
+        }
+    }
+
+    return implode("\n", $lines) . "\n";
+}
+
+/**
+ * Remembers, per mapping and new DSN, when a forward last succeeded and when and why one
+ * last failed, for the admin endpoint. Kept next to the metrics file.
+ */
+function forwardStatusPath()
+{
+    return dirname(metricsPath()) . '/sentry-forwarder-status.json';
+}
+
+function recordForwardStatus($mapping, $error)
+{
+    updateStateFile(forwardStatusPath(), function ($status) use ($mapping, $error) {
+        $entry = &$status[md5($mapping['old_dsn'])][dsnLabel($mapping['new_uri'])];
+
+        if (is_null($error)) {
+            $entry['last_success_at'] = date(DATE_RFC3339);
+        } else {
+            $entry['last_error_at'] = date(DATE_RFC3339);
+            $entry['last_error'] = $error;
+        }
+
+        return [$status, null];
+    });
+}
+
+/**
+ * The recorded forward status of a mapping, keyed by new DSN label.
+ */
+function forwardStatus($mapping)
+{
+    return readStateFile(forwardStatusPath())[md5($mapping['old_dsn'])] ?? [];
+}
+
+/**
+ * Identifies a DSN in logs and metrics without its public key.
+ */
+function dsnLabel($uri)
+{
+    // The catch-all mapping's old "*" has no host
+    if (!isset($uri['host'])) {
+        return '*';
+    }
+
+    return $uri['scheme'] . '://' . $uri['host'] . (isset($uri['port']) ? ':' . $uri['port'] : '') . ($uri['path'] ?? '');
+}
@@ -0,0 +1,155 @@
+<?php
+
+// The on-disk spool of forwards waiting for (re)delivery
+
+use GuzzleHttp\Client;
+use GuzzleHttp\Exception\GuzzleException;
+use Psr\Http\Message\ResponseInterface as Response;
+
+/**
+ * With SPOOL_DIR set, forwards that still fail after retries are written there as one
+ * JSON file each, named so that they sort oldest first.
+ */
+function spoolEntries()
+{
+    $dir = env('SPOOL_DIR');
+
+    return is_null($dir) ? [] : glob($dir . '/*.json');
+}
+
+/**
+ * Whether the spool holds SPOOL_MAX_ENTRIES, the bound on queued async forwards.
+ */
+function spoolFull()
+{
+    return count(spoolEntries()) >= (int) env('SPOOL_MAX_ENTRIES', 1000);
+}
+
+function isForwardFailure($result)
+{
+    return !$result instanceof Response || in_array($result->getStatusCode(), [502, 503, 504], true);
+}
+
+/**
+ * Persists a failed forward for later delivery and, once the spool holds more than
+ * SPOOL_MAX_ENTRIES, discards the oldest entries. Returns whether it was spooled.
+ */
+function spoolForward($url, $options, $mapping)
+{
+    $dir = env('SPOOL_DIR');
+
+    // Multipart bodies are assembled by Guzzle and cannot be replayed from here
+    if (is_null($dir) || !isset($options['body'])) {
+        return false;
+    }
+
+    if (!is_dir($dir) && !@mkdir($dir, 0775, true) && !is_dir($dir)) {
+        return false;
+    }
+
+    $entry = [
+        'url' => $url,
+        'headers' => $options['headers'],
+        'body' => base64_encode((string) $options['body']),
+        'old_dsn' => dsnLabel($mapping['old_uri']),
+        'new_dsn' => dsnLabel($mapping['new_uri']),
+        'attempts' => 0,
+        'next_attempt' => time(),
+    ];
+
+    $file = $dir . '/' . str_replace('.', '', sprintf('%.6F', microtime(true))) . '-' . bin2hex(random_bytes(4)) . '.json';
+
+    if (file_put_contents($file . '.tmp', json_encode($entry)) === false || !rename($file . '.tmp', $file)) {
+        return false;
+    }
+
+    incrementCounter('sentry_forwarder_spooled_total');
+
+    $entries = spoolEntries();
+    $overflow = count($entries) - (int) env('SPOOL_MAX_ENTRIES', 1000);
+
+    foreach (array_slice($entries, 0, max(0, $overflow)) as $oldest) {
+        if (@unlink($oldest)) {
+            incrementCounter('sentry_forwarder_spool_dropped_total');
+        }
+    }
+
+    return true;
+}
+
+/**
+ * Re-sends up to SPOOL_DRAIN_BATCH entries that are due, for bin/spool-worker; live
+ * requests never drain, so an SDK never waits on someone else's backlog. Each failed
+ * retry pushes the entry back with exponential backoff. Returns how many entries were
+ * attempted.
+ */
+function drainSpool(Client $client)
+{
+    $batch = (int) env('SPOOL_DRAIN_BATCH', 5);
+    $budget = $batch;
+
+    recoverSpool();
+
+    foreach (spoolEntries() as $file) {
+        if ($budget <= 0) {
+            break;
+        }
+
+        $entry = json_decode((string) @file_get_contents($file), true);
+
+        if (!is_array($entry) || $entry['next_attempt'] > time()) {
+            continue;
+        }
+
+        // Claim the entry so concurrent requests don't deliver it twice
+        if (!@rename($file, $file . '.sending')) {
+            continue;
+        }
+
+        touch($file . '.sending');
+        $budget--;
+
+        try {
+            $result = $client->request('POST', $entry['url'], [
+                'headers' => $entry['headers'],
+                'body' => base64_decode($entry['body']),
+            ]);
+        } catch (GuzzleException $e) {
+            $result = $e;
+        }
+
+        if (!isForwardFailure($result)) {
+            unlink($file . '.sending');
+            logEvent('info', 'Delivered spooled event', ['old_dsn' => $entry['old_dsn'], 'new_dsn' => $entry['new_dsn']]);
+            incrementCounter('sentry_forwarder_spool_drained_total');
+            continue;
+        }
+
+        $entry['attempts']++;
+        $entry['next_attempt'] = time() + min(3600, (int) env('SPOOL_RETRY_DELAY', 30) * 2 ** ($entry['attempts'] - 1));
+
+        // Put the entry back in one step, so a worker killed here still leaves a sound copy
+        file_put_contents($file . '.tmp', json_encode($entry));
+        rename($file . '.tmp', $file);
+        unlink($file . '.sending');
+    }
+
+    return $batch - $budget;
+}
+
+/**
+ * A worker killed mid-delivery (e.g. by a redeploy) leaves its claimed entry behind as
+ * .sending. Once such a claim is older than any forward could take, it goes back in the
+ * spool; at worst the event is delivered twice rather than lost.
+ */
+function recoverSpool()
+{
+    $dir = env('SPOOL_DIR');
+    $stale = 2 * (float) env('FORWARD_TIMEOUT', 30) * max(1, (int) env('FORWARD_MAX_ATTEMPTS', 3));
+
+    foreach (is_null($dir) ? [] : glob($dir . '/*.json.sending') as $claimed) {
+        if (@filemtime($claimed) < time() - $stale && @rename($claimed, substr($claimed, 0, -strlen('.sending')))) {
+            logEvent('warn', 'Recovered abandoned spool entry', ['file' => basename($claimed)]);
+        }
+    }
+}
@@ -0,0 +1,32 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class AcceptsGzipTest extends TestCase
+{
+    public static function acceptEncodings()
+    {
+        return [
+            'gzip' => ['gzip', true],
+            'list' => ['gzip, deflate, br', true],
+            'upper case' => ['GZIP', true],
+            'weighted' => ['br;q=1.0, gzip;q=0.5', true],
+            'other codings only' => ['deflate, br', false],
+            'identity' => ['identity', false],
+            'empty' => ['', false],
+            'wildcard' => ['*', true],
+            'refused' => ['gzip;q=0', false],
+            'wildcard refused' => ['*;q=0', false],
+            'refused despite wildcard' => ['gzip;q=0, *', false],
+            'wildcard then refused' => ['*, gzip;q=0', false],
+            'accepted despite refused wildcard' => ['*;q=0, gzip', true],
+        ];
+    }
+
+    #[DataProvider('acceptEncodings')]
+    public function testHonoursAcceptEncoding($header, $expected)
+    {
+        $this->assertSame($expected, acceptsGzip($header));
+    }
+}
@@ -0,0 +1,116 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+/**
+ * Left out of the default run; `composer test -- --testsuite benchmark` runs these and prints
+ * their measurements.
+ */
+class BenchmarkTest extends TestCase
+{
+    private $metrics;
+
+    protected function setUp(): void
+    {
+        $this->metrics = tempnam(sys_get_temp_dir(), 'metrics');
+        putenv('METRICS_PATH=' . $this->metrics);
+    }
+
+    protected function tearDown(): void
+    {
+        putenv('METRICS_PATH');
+        @unlink($this->metrics);
+    }
+
+    private function report($name, $before, $after, $unit)
+    {
+        fwrite(STDERR, sprintf("\n%s: %s %s before, %s %s after\n", $name, number_format($before), $unit, number_format($after), $unit));
+    }
+
+    public function testIndexedMappingLookup()
+    {
+        $config = [];
+
+        for ($i = 1; $i <= 200; $i++) {
+            $config[] = ['old' => "https://old$i@old.example.com/$i", 'new' => "https://new$i@new.example.com/$i"];
+        }
+
+        // What getMapping() did before: parse every candidate's DSNs on every request
+        $parseEach = function ($oldKey) use ($config) {
+            foreach ($config as $dsnMapping) {
+                $old = parse_url($dsnMapping['old']);
+                $new = parse_url($dsnMapping['new']);
+
+                if ($old['user'] === $oldKey) {
+                    return ['old_uri' => $old, 'new_uri' => $new];
+                }
+            }
+
+            return null;
+        };
+
+        $start = hrtime(true);
+
+        for ($i = 0; $i < 1000; $i++) {
+            $parseEach('old200');
+        }
+
+        $before = hrtime(true) - $start;
+        $start = hrtime(true);
+        $mappings = buildMappings($config);
+
+        for ($i = 0; $i < 1000; $i++) {
+            getMapping('old200', null, $mappings);
+        }
+
+        $after = hrtime(true) - $start;
+        $this->report('1000 lookups over 200 mappings', $before, $after, 'ns');
+
+        $this->assertSame('new200', getMapping('old200', null, $mappings)['new_uri']['user']);
+        $this->assertLessThan($before, $after);
+    }
+
+    public function testStreamedAttachmentEnvelopeMemory()
+    {
+        $old = 'https://oldkey@old.example.com/1';
+        $mapping = array_merge(buildMapping($old, ['old' => $old, 'new' => 'https://newkey@new.example.com/2']), ['envelope' => true, 'inject_dsn' => true]);
+
+        // Written a chunk at a time so building the 10 MB envelope doesn't count against either side
+        $path = tempnam(sys_get_temp_dir(), 'envelope');
+        $file = fopen($path, 'w');
+        fwrite($file, '{"dsn":"' . $old . "\"}\n{\"type\":\"attachment\",\"length\":" . (10 * 1024 * 1024) . "}\n");
+
+        for ($i = 0; $i < 10; $i++) {
+            fwrite($file, str_repeat('a', 1024 * 1024));
+        }
+
+        fclose($file);
+        $size = filesize($path);
+        $stream = new GuzzleHttp\Psr7\Stream(fopen($path, 'r'));
+
+        // Before: the whole body read into memory and rewritten as a string
+        memory_reset_peak_usage();
+        $base = memory_get_usage();
+        $stream->rewind();
+        list($body) = convertPayload($stream->getContents(), $mapping, 'identity', PHP_INT_MAX);
+        $before = memory_get_peak_usage() - $base;
+        unset($body);
+
+        // After: only the header line is buffered, and the rest is read as it is sent
+        memory_reset_peak_usage();
+        $base = memory_get_usage();
+        list($body, $length) = streamPayload($stream, $size, $mapping, 64 * 1024);
+
+        while (!$body->eof()) {
+            $body->read(65536);
+        }
+
+        $after = memory_get_peak_usage() - $base;
+        unlink($path);
+        $this->report('Peak memory forwarding a 10 MB attachment envelope', $before, $after, 'bytes');
+
+        $this->assertSame($size + strlen('https://newkey@new.example.com/2') - strlen($old), $length);
+        $this->assertLessThan(1024 * 1024, $after);
+        $this->assertGreaterThan(10 * 1024 * 1024, $before);
+    }
+}
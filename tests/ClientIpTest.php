@@ -0,0 +1,96 @@
+<?php
+
+use GuzzleHttp\Psr7\ServerRequest;
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class ClientIpTest extends TestCase
+{
+    protected function tearDown(): void
+    {
+        putenv('TRUSTED_PROXIES');
+    }
+
+    public static function cidrs()
+    {
+        return [
+            'ipv4 inside' => ['10.1.2.3', '10.0.0.0/8', true],
+            'ipv4 outside' => ['11.0.0.1', '10.0.0.0/8', false],
+            'ipv4 partial byte inside' => ['192.168.1.130', '192.168.1.128/25', true],
+            'ipv4 partial byte outside' => ['192.168.1.127', '192.168.1.128/25', false],
+            'ipv4 single address' => ['10.0.0.1', '10.0.0.1', true],
+            'ipv4 everything' => ['1.2.3.4', '0.0.0.0/0', true],
+            'ipv6 inside' => ['2001:db8::1', '2001:db8::/32', true],
+            'ipv6 outside' => ['2001:db9::1', '2001:db8::/32', false],
+            'ipv4 against ipv6' => ['10.0.0.1', '2001:db8::/32', false],
+            'mapped ipv4 against ipv4' => ['::ffff:10.0.0.1', '10.0.0.0/8', false],
+            'not an address' => ['not-an-ip', '10.0.0.0/8', false],
+            'ipv6 single address' => ['2001:db8::1', '2001:db8::1/128', true],
+            'empty prefix' => ['1.2.3.4', '10.0.0.0/', false],
+            'prefix not a number' => ['1.2.3.4', '10.0.0.0/x', false],
+            'negative prefix' => ['10.1.2.3', '10.0.0.0/-8', false],
+            'ipv4 prefix too long' => ['10.0.0.1', '10.0.0.1/33', false],
+            'ipv6 prefix too long' => ['2001:db8::1', '2001:db8::/129', false],
+        ];
+    }
+
+    #[DataProvider('cidrs')]
+    public function testMatchesCidrs($ip, $cidr, $expected)
+    {
+        $this->assertSame($expected, ipInCidr($ip, $cidr));
+    }
+
+    public static function addresses()
+    {
+        return [
+            'ipv4' => ['10.0.0.1', '10.0.0.1'],
+            'ipv4 with port' => ['10.0.0.1:5000', '10.0.0.1'],
+            'padded' => [' 10.0.0.1 ', '10.0.0.1'],
+            'ipv6' => ['2001:db8::1', '2001:db8::1'],
+            'ipv6 loopback' => ['::1', '::1'],
+            'bracketed ipv6' => ['[2001:db8::1]', '2001:db8::1'],
+            'bracketed ipv6 with port' => ['[2001:db8::1]:443', '2001:db8::1'],
+        ];
+    }
+
+    #[DataProvider('addresses')]
+    public function testNormalizesAddresses($address, $expected)
+    {
+        $this->assertSame($expected, normalizeIp($address));
+    }
+
+    public static function forwardedRequests()
+    {
+        return [
+            'untrusted peer ignores the header' => ['203.0.113.5', '1.2.3.4', '203.0.113.5'],
+            'no header' => ['10.0.0.2', null, '10.0.0.2'],
+            'one hop' => ['10.0.0.2', '198.51.100.7', '198.51.100.7'],
+            'trusted hops are skipped' => ['10.0.0.2', '198.51.100.7, 10.0.0.3', '198.51.100.7'],
+            'spoofed leftmost entry is ignored' => ['10.0.0.2', '6.6.6.6, 198.51.100.7', '198.51.100.7'],
+            'all hops trusted' => ['10.0.0.2', '10.0.0.5, 10.0.0.4', '10.0.0.5'],
+            'ipv6 hop' => ['10.0.0.2', '2001:db8::7', '2001:db8::7'],
+            'hops with ports and brackets' => ['10.0.0.2', '[2001:db8::7]:1234, 10.0.0.3:80', '2001:db8::7'],
+            'peer with port' => ['10.0.0.2:5555', '198.51.100.7:4000', '198.51.100.7'],
+        ];
+    }
+
+    #[DataProvider('forwardedRequests')]
+    public function testTakesTheFirstUntrustedForwardedHop($peer, $forwardedFor, $expected)
+    {
+        putenv('TRUSTED_PROXIES=10.0.0.0/8');
+
+        $this->assertSame($expected, clientIp($this->request($peer, $forwardedFor)));
+    }
+
+    public function testIgnoresForwardedForWithoutTrustedProxies()
+    {
+        $this->assertSame('10.0.0.2', clientIp($this->request('10.0.0.2', '198.51.100.7')));
+    }
+
+    private function request($peer, $forwardedFor)
+    {
+        $headers = is_null($forwardedFor) ? [] : ['X-Forwarded-For' => $forwardedFor];
+
+        return new ServerRequest('POST', '/api/1/envelope/', $headers, null, '1.1', ['REMOTE_ADDR' => $peer]);
+    }
+}
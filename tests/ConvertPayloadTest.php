@@ -0,0 +1,87 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class ConvertPayloadTest extends TestCase
+{
+    const OLD_DSN = 'https://oldkey@old.example.com/1';
+    const NEW_DSN = 'https://newkey@new.example.com/2';
+
+    private $metrics;
+
+    protected function setUp(): void
+    {
+        $this->metrics = tempnam(sys_get_temp_dir(), 'metrics');
+        putenv('METRICS_PATH=' . $this->metrics);
+    }
+
+    protected function tearDown(): void
+    {
+        putenv('METRICS_PATH');
+        @unlink($this->metrics);
+    }
+
+    private function envelopeMapping($dsnMapping = [])
+    {
+        return array_merge(buildMapping(self::OLD_DSN, array_merge(['old' => self::OLD_DSN, 'new' => self::NEW_DSN], $dsnMapping)), ['envelope' => true, 'inject_dsn' => true]);
+    }
+
+    public function testRewritesOnlyTheHeaderOfAMultiItemEnvelope()
+    {
+        // An escaped slash, the old key and bare newlines in the items must all come through as sent
+        $items = "{\"type\":\"event\",\"length\":47}\n{\"message\":\"hi oldkey\",\"extra\":{\"path\":\"a\\/b\"}}\n"
+            . "{\"type\":\"attachment\",\"length\":11,\"filename\":\"dump.bin\"}\n\x00oldkey\n\xff\r\n\n";
+        $payload = '{"event_id":"abc","dsn":"' . self::OLD_DSN . "\",\"sent_at\":\"2024-01-01T00:00:00Z\"}\n" . $items;
+
+        list($body, $size, $eventId) = convertPayload(gzencode($payload), $this->envelopeMapping(), 'gzip', 1024 * 1024);
+        $decoded = gzdecode($body);
+
+        $this->assertSame('{"event_id":"abc","dsn":"' . self::NEW_DSN . "\",\"sent_at\":\"2024-01-01T00:00:00Z\"}\n" . $items, $decoded);
+        $this->assertSame(strlen($decoded), $size);
+        $this->assertSame('abc', $eventId);
+    }
+
+    public static function payloadDsnSettings()
+    {
+        return [
+            'header only' => [false],
+            'payload dsn too' => [true],
+        ];
+    }
+
+    #[DataProvider('payloadDsnSettings')]
+    public function testLeavesTheOldKeyInEventDataAlone($rewritePayloadDsn)
+    {
+        $event = '{"message":"Rejected public key oldkey","tags":{"old_key":"oldkey"},"breadcrumbs":[{"message":"https://oldkey@old.example.com"}]}';
+        $payload = '{"dsn":"' . self::OLD_DSN . "\"}\n{\"type\":\"event\"}\n" . $event;
+
+        list($body) = convertPayload($payload, $this->envelopeMapping(['rewrite_payload_dsn' => $rewritePayloadDsn]), null, 1024);
+
+        $this->assertSame('{"dsn":"' . self::NEW_DSN . "\"}\n{\"type\":\"event\"}\n" . $event, $body);
+    }
+
+    public function testInjectsTheNewDsnIntoAHeaderWithNone()
+    {
+        list($body) = convertPayload("{\"event_id\":\"abc\"}\n{\"type\":\"event\"}\n{}", $this->envelopeMapping(), null, 1024);
+
+        $this->assertSame("{\"event_id\":\"abc\",\"dsn\":\"" . self::NEW_DSN . "\"}\n{\"type\":\"event\"}\n{}", $body);
+        $this->assertSame(1, readStateFile($this->metrics)['sentry_forwarder_envelope_dsn_injected_total'][metricLabels(['old_dsn' => dsnLabel(parse_url(self::OLD_DSN))])]);
+    }
+
+    public function testCountsAHeaderDsnThatDoesNotMatch()
+    {
+        list($body) = convertPayload('{"dsn":"' . self::OLD_DSN . "\"}\n{\"type\":\"event\"}\n{}", $this->envelopeMapping(), null, 1024);
+
+        $this->assertSame('{"dsn":"' . self::NEW_DSN . "\"}\n{\"type\":\"event\"}\n{}", $body);
+        $this->assertSame(1, readStateFile($this->metrics)['sentry_forwarder_envelope_dsn_mismatch_total'][metricLabels(['old_dsn' => dsnLabel(parse_url(self::OLD_DSN))])]);
+    }
+
+    public function testLeavesAMatchingHeaderUntouched()
+    {
+        $payload = '{"dsn":"' . self::NEW_DSN . "\"}\n{\"type\":\"event\"}\n{}";
+
+        $this->assertSame($payload, convertPayload($payload, $this->envelopeMapping(), null, 1024)[0]);
+        $this->assertArrayNotHasKey('sentry_forwarder_envelope_dsn_mismatch_total', readStateFile($this->metrics));
+    }
+}
@@ -0,0 +1,49 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class DecodePayloadTest extends TestCase
+{
+    public function testInflatesCompleteGzip()
+    {
+        $this->assertSame('hello world', inflateLimited(gzencode('hello world'), ZLIB_ENCODING_GZIP, 1024));
+    }
+
+    public function testRejectsTruncatedGzip()
+    {
+        $payload = gzencode(str_repeat('hello world ', 100));
+
+        // Cut into the trailer, and well into the data
+        $this->assertFalse(inflateLimited(substr($payload, 0, -4), ZLIB_ENCODING_GZIP, 1024 * 1024));
+        $this->assertFalse(inflateLimited(substr($payload, 0, intdiv(strlen($payload), 2)), ZLIB_ENCODING_GZIP, 1024 * 1024));
+    }
+
+    public function testRejectsCorruptGzip()
+    {
+        $this->assertFalse(inflateLimited("\x1f\x8b not really gzip", ZLIB_ENCODING_GZIP, 1024));
+    }
+
+    public function testStopsAtTheSizeLimit()
+    {
+        $this->expectException(PayloadTooLargeException::class);
+
+        inflateLimited(gzencode(str_repeat('a', 10000)), ZLIB_ENCODING_GZIP, 100);
+    }
+
+    public function testReportsTruncationAsADecompressError()
+    {
+        try {
+            decodePayload(substr(gzencode('hello world'), 0, -4), 'gzip', 1024);
+            $this->fail('Expected a PayloadException');
+        } catch (PayloadException $e) {
+            $this->assertSame('decompress', $e->reason);
+            $this->assertSame(400, $e->status);
+        }
+    }
+
+    public function testAcceptsZlibAndRawDeflate()
+    {
+        $this->assertSame('hello world', decodePayload(gzcompress('hello world'), 'deflate', 1024));
+        $this->assertSame('hello world', decodePayload(gzdeflate('hello world'), 'deflate', 1024));
+    }
+}
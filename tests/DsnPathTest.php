@@ -0,0 +1,44 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class DsnPathTest extends TestCase
+{
+    public static function dsns()
+    {
+        return [
+            'short form' => ['https://key@sentry.example/42', ['', '42']],
+            'trailing slash' => ['https://key@sentry.example/42/', ['', '42']],
+            'path prefix' => ['https://key@sentry.example/sentry/42', ['/sentry', '42']],
+            'full form' => ['https://key@sentry.example/api/42/envelope/', ['', '42']],
+            'full form without endpoint' => ['https://key@sentry.example/api/42/', ['', '42']],
+            'full form store' => ['https://key@sentry.example/api/42/store/', ['', '42']],
+            'full form with prefix' => ['https://key@sentry.example/sentry/api/42/store/', ['/sentry', '42']],
+        ];
+    }
+
+    #[DataProvider('dsns')]
+    public function testSplitsPrefixAndProjectId($dsn, $expected)
+    {
+        $this->assertSame($expected, splitDsnPath(parse_url($dsn)));
+    }
+
+    public static function upstreamUrls()
+    {
+        return [
+            'short form' => ['https://key@sentry.example/42', 'envelope', null, 'https://sentry.example/api/42/envelope/'],
+            'prefix and port' => ['https://key@sentry.example:9000/sentry/42', 'store', null, 'https://sentry.example:9000/sentry/api/42/store/'],
+            'default port dropped' => ['http://key@sentry.example:80/42', 'envelope', null, 'http://sentry.example/api/42/envelope/'],
+            'full form' => ['https://key@sentry.example/api/42/envelope/', 'minidump', null, 'https://sentry.example/api/42/minidump/'],
+            'template' => ['https://key@relay.example/42', 'envelope', '/relay/{project}/{endpoint}/', 'https://relay.example/relay/42/envelope/'],
+            'template with doubled slashes' => ['https://key@relay.example/42', 'envelope', '/relay//{project}/', 'https://relay.example/relay/42/'],
+        ];
+    }
+
+    #[DataProvider('upstreamUrls')]
+    public function testBuildsUpstreamUrls($dsn, $endpoint, $template, $expected)
+    {
+        $this->assertSame($expected, upstreamUrl(parse_url($dsn), $endpoint, $template));
+    }
+}
@@ -0,0 +1,75 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class EnvelopeItemsTest extends TestCase
+{
+    public function testSplitsItemsWithoutLengthAtNewlines()
+    {
+        $items = parseEnvelopeItems("{\"type\":\"event\"}\n{\"a\":1}\n");
+
+        $this->assertCount(1, $items);
+        $this->assertSame('{"type":"event"}', $items[0]['header_line']);
+        $this->assertSame('{"a":1}', $items[0]['payload']);
+        $this->assertSame("\n", $items[0]['terminator']);
+    }
+
+    public function testKeepsNewlinesInsideItemsWithLength()
+    {
+        $items = parseEnvelopeItems("{\"type\":\"attachment\",\"length\":5}\na\nb\nc\n{\"type\":\"event\"}\n{}");
+
+        $this->assertCount(2, $items);
+        $this->assertSame("a\nb\nc", $items[0]['payload']);
+        $this->assertSame('event', $items[1]['header']->type);
+        $this->assertSame('{}', $items[1]['payload']);
+        $this->assertSame('', $items[1]['terminator']);
+    }
+
+    public static function envelopeItems()
+    {
+        return [
+            'single event' => ["{\"type\":\"event\"}\n{\"a\":1}\n"],
+            'no trailing newline' => ["{\"type\":\"event\"}\n{\"a\":1}"],
+            'binary attachment' => ["{\"type\":\"attachment\",\"length\":6}\n\x00\n\xff\n\r\n\n{\"type\":\"event\"}\n{}\n"],
+            'empty attachment' => ["{\"type\":\"attachment\",\"length\":0}\n\n{\"type\":\"event\"}\n{}"],
+        ];
+    }
+
+    #[DataProvider('envelopeItems')]
+    public function testSerializesBackByteForByte($items)
+    {
+        $this->assertSame($items, serializeEnvelopeItems(parseEnvelopeItems($items)));
+    }
+
+    public static function brokenItems()
+    {
+        return [
+            'header not json' => ["not json\n{}"],
+            'length past the end' => ["{\"type\":\"attachment\",\"length\":50}\nshort"],
+            'negative length' => ["{\"type\":\"attachment\",\"length\":-1}\nx"],
+            'length not a number' => ["{\"type\":\"attachment\",\"length\":\"5\"}\nabcde"],
+        ];
+    }
+
+    #[DataProvider('brokenItems')]
+    public function testRejectsBrokenItems($items)
+    {
+        try {
+            parseEnvelopeItems($items);
+            $this->fail('Expected a PayloadException');
+        } catch (PayloadException $e) {
+            $this->assertSame('envelope_parse', $e->reason);
+            $this->assertSame(400, $e->status);
+        }
+    }
+
+    public function testReplacingAPayloadUpdatesItsLength()
+    {
+        $item = parseEnvelopeItems("{\"type\":\"attachment\",\"length\":5}\nabcde")[0];
+        $item = withItemPayload($item, 'xyz');
+
+        $this->assertSame('{"type":"attachment","length":3}', $item['header_line']);
+        $this->assertSame("{\"type\":\"attachment\",\"length\":3}\nxyz", serializeEnvelopeItems([$item]));
+    }
+}
@@ -0,0 +1,53 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class ExpandEnvTest extends TestCase
+{
+    protected function setUp(): void
+    {
+        putenv('OLD_SENTRY_KEY=oldkey');
+        putenv('NEW_SENTRY_DSN=https://newkey@new.example.com/2');
+    }
+
+    protected function tearDown(): void
+    {
+        putenv('OLD_SENTRY_KEY');
+        putenv('NEW_SENTRY_DSN');
+    }
+
+    public function testExpandsOldAndNew()
+    {
+        $config = expandEnv(['dsn_mapping' => [
+            ['old' => 'https://${OLD_SENTRY_KEY}@old.example.com/1', 'new' => '${NEW_SENTRY_DSN}'],
+            ['old' => ['https://${OLD_SENTRY_KEY}@old.example.com/3', '*'], 'new' => ['${NEW_SENTRY_DSN}', 'https://backupkey@backup.example.com/2']],
+        ]]);
+
+        $this->assertSame([
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2'],
+            ['old' => ['https://oldkey@old.example.com/3', '*'], 'new' => ['https://newkey@new.example.com/2', 'https://backupkey@backup.example.com/2']],
+        ], $config['dsn_mapping']);
+    }
+
+    public function testExpandsWithinProfiles()
+    {
+        $config = expandEnv(['profiles' => ['eu' => ['dsn_mapping' => [['old' => 'https://${OLD_SENTRY_KEY}@old.example.com/1', 'new' => '${NEW_SENTRY_DSN}']]]]]);
+
+        $this->assertSame('https://newkey@new.example.com/2', $config['profiles']['eu']['dsn_mapping'][0]['new']);
+    }
+
+    public function testLeavesOtherFieldsAlone()
+    {
+        $mapping = ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2', 'forward_host' => '${UNSET_SENTRY_HOST}'];
+
+        $this->assertSame(['dsn_mapping' => [$mapping]], expandEnv(['dsn_mapping' => [$mapping]]));
+    }
+
+    public function testAMissingVariableIsAnError()
+    {
+        $this->expectException(RuntimeException::class);
+        $this->expectExceptionMessage('dsn_mapping[0].new[1]: environment variable MISSING_SENTRY_DSN is not set');
+
+        expandEnv(['dsn_mapping' => [['old' => 'https://oldkey@old.example.com/1', 'new' => ['${NEW_SENTRY_DSN}', '${MISSING_SENTRY_DSN}']]]]);
+    }
+}
@@ -0,0 +1,167 @@
+<?php
+
+use GuzzleHttp\Client;
+use GuzzleHttp\Handler\MockHandler;
+use GuzzleHttp\HandlerStack;
+use GuzzleHttp\Middleware;
+use GuzzleHttp\Psr7\Response;
+use GuzzleHttp\Psr7\ServerRequest;
+use PHPUnit\Framework\TestCase;
+use SentryForwarder\Forwarder;
+
+/**
+ * Whole requests through Forwarder::handle(), with the upstream replaced by a MockHandler
+ * and every request sent to it kept in $sent.
+ */
+class ForwarderTest extends TestCase
+{
+    const OLD_DSN = 'https://oldkey@old.example.com/1';
+    const NEW_DSN = 'https://newkey@new.example.com/2';
+    const OTHER_DSN = 'https://otherkey@other.example.com/3';
+
+    private $stateDir;
+    private $sent = [];
+
+    protected function setUp(): void
+    {
+        // Metrics, forward status and the like all live next to METRICS_PATH
+        $this->stateDir = sys_get_temp_dir() . '/sentry-forwarder-test-' . bin2hex(random_bytes(4));
+        mkdir($this->stateDir);
+        putenv('METRICS_PATH=' . $this->stateDir . '/metrics.json');
+        putenv('LOG_LEVEL=error');
+    }
+
+    protected function tearDown(): void
+    {
+        foreach (['METRICS_PATH', 'LOG_LEVEL', 'QUIET_REJECT', 'MAX_BODY_SIZE', 'MAX_DECOMPRESSED_SIZE'] as $name) {
+            putenv($name);
+        }
+
+        array_map('unlink', glob($this->stateDir . '/*'));
+        rmdir($this->stateDir);
+    }
+
+    private function forwarder($dsnMapping, $responses = [])
+    {
+        $stack = HandlerStack::create(new MockHandler($responses));
+        $stack->push(Middleware::history($this->sent));
+
+        return new Forwarder(['dsn_mapping' => [$dsnMapping]], new Client(['handler' => $stack, 'http_errors' => false]));
+    }
+
+    private function event($body, $key = 'oldkey', $headers = [])
+    {
+        $headers += ['X-Sentry-Auth' => "Sentry sentry_version=7, sentry_key=$key"];
+
+        return new ServerRequest('POST', 'http://forwarder.example.com/api/1/envelope/', $headers, $body, '1.1', ['REMOTE_ADDR' => '127.0.0.1']);
+    }
+
+    private function envelope()
+    {
+        return '{"event_id":"abc123","dsn":"' . self::OLD_DSN . "\"}\n{\"type\":\"event\"}\n{\"message\":\"hello\"}\n";
+    }
+
+    public function testForwardsToTheNewDsn()
+    {
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN], [new Response(200, [], '{"id":"abc123"}')])
+            ->handle($this->event($this->envelope()));
+
+        $this->assertSame(200, $response->getStatusCode());
+        $this->assertCount(1, $this->sent);
+        $this->assertSame('new.example.com', $this->sent[0]['request']->getUri()->getHost());
+        $this->assertStringContainsString('sentry_key=newkey', $this->sent[0]['request']->getHeaderLine('X-Sentry-Auth'));
+        $this->assertStringStartsWith('{"event_id":"abc123","dsn":"' . self::NEW_DSN . '"}', (string) $this->sent[0]['request']->getBody());
+    }
+
+    public function testRewriteHookChangesReachTheUpstream()
+    {
+        $forwarder = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN], [new Response(200, [], '{"id":"abc123"}')]);
+        $forwarder->setRewriteHook(function ($header, $items) {
+            foreach ($items as &$item) {
+                if ($item['header']->type === 'event') {
+                    $event = json_decode($item['payload']);
+                    $event->tags = ['migration' => 'self-hosted'];
+                    $item['payload'] = json_encode($event);
+                }
+            }
+
+            return [$header, $items];
+        });
+
+        $response = $forwarder->handle($this->event($this->envelope()));
+        $sent = explode("\n", (string) $this->sent[0]['request']->getBody());
+
+        $this->assertSame(200, $response->getStatusCode());
+        $this->assertSame('{"event_id":"abc123","dsn":"' . self::NEW_DSN . '"}', $sent[0]);
+        $this->assertSame('{"message":"hello","tags":{"migration":"self-hosted"}}', $sent[2]);
+    }
+
+    public function testRejectsAnUnknownKey()
+    {
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN])->handle($this->event($this->envelope(), 'strangerkey'));
+
+        $this->assertSame(400, $response->getStatusCode());
+        $this->assertCount(0, $this->sent);
+    }
+
+    public function testQuietRejectAcceptsAnUnknownKey()
+    {
+        putenv('QUIET_REJECT=true');
+
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN])->handle($this->event($this->envelope(), 'strangerkey'));
+
+        $this->assertSame(200, $response->getStatusCode());
+        $this->assertSame('{}', (string) $response->getBody());
+        $this->assertCount(0, $this->sent);
+    }
+
+    public function testDropModeAcceptsWithoutForwarding()
+    {
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'mode' => 'drop'])->handle($this->event($this->envelope()));
+
+        $this->assertSame(200, $response->getStatusCode());
+        $this->assertSame('{"id":"abc123"}', (string) $response->getBody());
+        $this->assertCount(0, $this->sent);
+    }
+
+    public function testFanoutAnySucceedsIfOneTargetDoes()
+    {
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => [self::NEW_DSN, self::OTHER_DSN], 'fanout' => 'any'], [new Response(500), new Response(200, [], '{"id":"abc123"}')])
+            ->handle($this->event($this->envelope()));
+
+        $this->assertSame(200, $response->getStatusCode());
+        $this->assertCount(2, $this->sent);
+        $this->assertSame('other.example.com', $this->sent[1]['request']->getUri()->getHost());
+    }
+
+    public function testFanoutAllFailsIfOneTargetDoes()
+    {
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => [self::NEW_DSN, self::OTHER_DSN], 'fanout' => 'all'], [new Response(200, [], '{"id":"abc123"}'), new Response(500)])
+            ->handle($this->event($this->envelope()));
+
+        $this->assertSame(500, $response->getStatusCode());
+        $this->assertCount(2, $this->sent);
+    }
+
+    public function testRejectsADeclaredBodyOverTheLimit()
+    {
+        putenv('MAX_BODY_SIZE=100');
+
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN])
+            ->handle($this->event($this->envelope() . str_repeat('a', 200), 'oldkey', ['Content-Length' => (string) (strlen($this->envelope()) + 200)]));
+
+        $this->assertSame(413, $response->getStatusCode());
+        $this->assertCount(0, $this->sent);
+    }
+
+    public function testRejectsABodyThatDecompressesOverTheLimit()
+    {
+        putenv('MAX_DECOMPRESSED_SIZE=10000');
+
+        $response = $this->forwarder(['old' => self::OLD_DSN, 'new' => self::NEW_DSN])
+            ->handle($this->event(gzencode($this->envelope() . str_repeat('a', 1024 * 1024)), 'oldkey', ['Content-Encoding' => 'gzip']));
+
+        $this->assertSame(413, $response->getStatusCode());
+        $this->assertCount(0, $this->sent);
+    }
+}
@@ -0,0 +1,58 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class GetMappingTest extends TestCase
+{
+    /**
+     * sharedkey is mapped by key for project 2, and project 1 by project ID. The last two
+     * entries repeat that key and that project, so the first entries win.
+     */
+    private static function mappings()
+    {
+        return buildMappings([
+            ['old' => 'https://otherkey@old.example.com/1', 'new' => 'https://newkey@by-project.example.com/1', 'match_by' => 'project'],
+            ['old' => 'https://sharedkey@old.example.com/2', 'new' => 'https://newkey@by-key.example.com/2'],
+            ['old' => '*', 'new' => 'https://newkey@default.example.com/9'],
+            ['old' => 'https://sharedkey@old.example.com/1', 'new' => 'https://newkey@second-key.example.com/1'],
+            ['old' => 'https://otherkey@old.example.com/1', 'new' => 'https://newkey@second-project.example.com/1', 'match_by' => 'project'],
+        ]);
+    }
+
+    public static function lookups()
+    {
+        return [
+            'key beats project' => ['sharedkey', '1', 'by-key.example.com'],
+            'key alone' => ['sharedkey', null, 'by-key.example.com'],
+            'project when the key is unknown' => ['unknownkey', '1', 'by-project.example.com'],
+            'project without a key' => [null, '1', 'by-project.example.com'],
+            'default when neither matches' => ['unknownkey', '5', 'default.example.com'],
+            'default without key or project' => [null, null, 'default.example.com'],
+        ];
+    }
+
+    #[DataProvider('lookups')]
+    public function testPrecedence($oldKey, $projectId, $host)
+    {
+        $this->assertSame($host, getMapping($oldKey, $projectId, self::mappings())['new_uri']['host']);
+    }
+
+    public function testNoMatchWithoutADefault()
+    {
+        $mappings = buildMappings([['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/1', 'match_by' => 'project']]);
+
+        $this->assertNull(getMapping('oldkey', '2', $mappings));
+        $this->assertNull(getMapping(null, null, $mappings));
+    }
+
+    public function testDisabledMappingsAreSkipped()
+    {
+        $mappings = buildMappings([
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@disabled.example.com/1', 'enabled' => false],
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@enabled.example.com/1'],
+        ]);
+
+        $this->assertSame('enabled.example.com', getMapping('oldkey', '1', $mappings)['new_uri']['host']);
+    }
+}
@@ -0,0 +1,86 @@
+<?php
+
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\TestCase;
+
+class ValidateConfigTest extends TestCase
+{
+    public function testAcceptsAValidConfig()
+    {
+        $this->assertSame([], validateConfig(['dsn_mapping' => [
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2'],
+            ['old' => ['https://otherkey@old.example.com/3', '*'], 'new' => ['https://newkey@new.example.com/4', 'https://newkey@backup.example.com/4']],
+        ]]));
+    }
+
+    public static function brokenConfigs()
+    {
+        return [
+            'missing user' => [
+                [['old' => 'https://old.example.com/1', 'new' => 'https://newkey@new.example.com/2']],
+                ['dsn_mapping[0].old: missing public key'],
+            ],
+            'empty path' => [
+                [['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com']],
+                ['dsn_mapping[0].new: missing project ID'],
+            ],
+            'not a url' => [
+                [['old' => 'oldkey', 'new' => 'https://newkey@new.example.com/2']],
+                ['dsn_mapping[0].old: not a valid DSN URL'],
+            ],
+            'duplicate key' => [
+                [
+                    ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2'],
+                    ['old' => 'https://oldkey@old.example.com/3', 'new' => 'https://newkey@new.example.com/4'],
+                ],
+                ['dsn_mapping[1].old: duplicates the key of dsn_mapping[0].old'],
+            ],
+            'duplicate project' => [
+                [
+                    ['old' => 'https://onekey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2', 'match_by' => 'project'],
+                    ['old' => ['https://twokey@old.example.com/5', 'https://threekey@old.example.com/1'], 'new' => 'https://newkey@new.example.com/4', 'match_by' => 'project'],
+                ],
+                ['dsn_mapping[1].old[1]: duplicates the project of dsn_mapping[0].old'],
+            ],
+            'not a mapping' => [
+                ['https://oldkey@old.example.com/1'],
+                ['dsn_mapping[0]: must be a mapping'],
+            ],
+            'empty mapping' => [
+                [null],
+                ['dsn_mapping[0]: must be a mapping'],
+            ],
+        ];
+    }
+
+    #[DataProvider('brokenConfigs')]
+    public function testReportsProblems($dsnMapping, $problems)
+    {
+        $this->assertSame($problems, validateConfig(['dsn_mapping' => $dsnMapping]));
+    }
+
+    public function testListsEveryProblem()
+    {
+        $problems = validateConfig(['dsn_mapping' => [
+            ['old' => 'https://old.example.com/', 'new' => 'https://newkey@new.example.com/2'],
+            'not a mapping',
+            ['new' => 'https://newkey@new.example.com/2', 'fanout' => 'some'],
+        ]]);
+
+        $this->assertSame([
+            'dsn_mapping[0].old: missing public key',
+            'dsn_mapping[0].old: missing project ID',
+            'dsn_mapping[1]: must be a mapping',
+            'dsn_mapping[2].old: missing',
+            'dsn_mapping[2].fanout: must be "any" or "all"',
+        ], $problems);
+    }
+
+    public function testDisabledMappingsMayShareAKey()
+    {
+        $this->assertSame([], validateConfig(['dsn_mapping' => [
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/2'],
+            ['old' => 'https://oldkey@old.example.com/1', 'new' => 'https://newkey@new.example.com/3', 'enabled' => false],
+        ]]));
+    }
+}
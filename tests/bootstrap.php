@@ -0,0 +1,10 @@
+<?php
+
+// The forwarder is mostly plain functions, so the tests load them the way public/index.php does
+
+require_once __DIR__ . '/../vendor/autoload.php';
+require_once __DIR__ . '/../src/config.php';
+require_once __DIR__ . '/../src/client.php';
+require_once __DIR__ . '/../src/metrics.php';
+require_once __DIR__ . '/../src/spool.php';
+require_once __DIR__ . '/../src/forwarding.php';